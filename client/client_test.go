@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -135,6 +136,10 @@ func testMissing(t *testing.T, client *GitlabNetClient) {
 		require.EqualError(t, err, "Internal API error (404)")
 		require.Nil(t, response)
 
+		var apiErr *ApiError
+		require.True(t, errors.As(err, &apiErr))
+		require.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+
 		require.True(t, testhelper.WaitForLogEvent(hook))
 		entries := hook.AllEntries()
 		require.Equal(t, 1, len(entries))
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -26,12 +27,27 @@ type ErrorResponse struct {
 	Message string `json:"message"`
 }
 
+// ApiError is returned when the internal API responds with an error status.
+type ApiError struct {
+	StatusCode int
+	Msg        string
+}
+
+func (e *ApiError) Error() string {
+	return e.Msg
+}
+
 type GitlabNetClient struct {
-	httpClient *HttpClient
-	user       string
-	password   string
-	secret     string
-	userAgent  string
+	httpClient  *HttpClient
+	user        string
+	password    string
+	secret      string
+	userAgent   string
+	retryPolicy RetryPolicy
+	breaker     *CircuitBreaker
+	secretAuth  SecretAuth
+	// The time allowed for the requests to some endpoints, retries included.
+	endpointTimeouts map[string]time.Duration
 }
 
 func NewGitlabNetClient(
@@ -60,6 +76,32 @@ func (c *GitlabNetClient) SetUserAgent(ua string) {
 	c.userAgent = ua
 }
 
+// SetSecretAuth configures how subsequent requests are authenticated with the
+// shared secret. Only the Gitlab-Shared-Secret header is sent by default.
+func (c *GitlabNetClient) SetSecretAuth(auth SecretAuth) {
+	c.secretAuth = auth
+}
+
+// SetEndpointTimeouts limits the time allowed for subsequent requests to some
+// endpoints, including their retries and reading the response. The endpoints
+// are given by their path relative to /api/v4/internal, like
+// "/authorized_keys".
+func (c *GitlabNetClient) SetEndpointTimeouts(timeouts map[string]time.Duration) {
+	c.endpointTimeouts = timeouts
+}
+
+// SetRetryPolicy configures the retries of subsequent requests, which are
+// disabled by default.
+func (c *GitlabNetClient) SetRetryPolicy(policy RetryPolicy) {
+	c.retryPolicy = policy
+}
+
+// SetCircuitBreaker makes subsequent requests fail fast while the breaker is
+// open.
+func (c *GitlabNetClient) SetCircuitBreaker(breaker *CircuitBreaker) {
+	c.breaker = breaker
+}
+
 func normalizePath(path string) string {
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
@@ -100,9 +142,9 @@ func parseError(resp *http.Response) error {
 	parsedResponse := &ErrorResponse{}
 
 	if err := json.NewDecoder(resp.Body).Decode(parsedResponse); err != nil {
-		return fmt.Errorf("Internal API error (%v)", resp.StatusCode)
+		return &ApiError{StatusCode: resp.StatusCode, Msg: fmt.Sprintf("Internal API error (%v)", resp.StatusCode)}
 	} else {
-		return fmt.Errorf(parsedResponse.Message)
+		return &ApiError{StatusCode: resp.StatusCode, Msg: parsedResponse.Message}
 	}
 
 }
@@ -115,7 +157,77 @@ func (c *GitlabNetClient) Post(ctx context.Context, path string, data interface{
 	return c.DoRequest(ctx, http.MethodPost, normalizePath(path), data)
 }
 
+// DoRequest sends a request to the internal API. Requests failing because the
+// API is unavailable are retried according to the retry policy.
 func (c *GitlabNetClient) DoRequest(ctx context.Context, method, path string, data interface{}) (*http.Response, error) {
+	if !c.breaker.allow() {
+		apiCircuitBreakerRejections.Inc()
+		log.WithFields(log.Fields{
+			"correlation_id": correlation.ExtractFromContext(ctx),
+			"method":         method,
+			"path":           path,
+		}).Error("Internal API unreachable, circuit breaker is open")
+		return nil, &unreachableError{err: errors.New("circuit breaker is open")}
+	}
+
+	endpoint := endpointLabel(path)
+
+	// The timeout of an endpoint bounds all the attempts, backoffs included.
+	requestCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout := c.endpointTimeouts[endpoint]; timeout > 0 {
+		requestCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	for retry := 0; ; retry++ {
+		apiRequestAttempts.WithLabelValues(method, endpoint).Inc()
+
+		response, err := c.doRequest(requestCtx, method, path, data)
+		if err == nil {
+			c.breaker.record(false)
+			// The response is read with the context of the request.
+			response.Body = &cancelingBody{ReadCloser: response.Body, cancel: cancel}
+			return response, nil
+		}
+		// The failure says nothing about the API when the request was canceled.
+		if ctx.Err() != nil {
+			cancel()
+			return nil, err
+		}
+
+		if retry >= c.retryPolicy.Retries || !shouldRetry(method, err) {
+			cancel()
+			c.breaker.record(IsUnavailable(err))
+			return nil, err
+		}
+
+		// No retry is made once the timeout of the endpoint is over.
+		if sleep(requestCtx, c.retryPolicy.backoff(retry)) != nil {
+			cancel()
+			if ctx.Err() == nil {
+				c.breaker.record(IsUnavailable(err))
+			}
+			return nil, err
+		}
+
+		apiRequestRetries.WithLabelValues(method, endpoint).Inc()
+	}
+}
+
+// cancelingBody releases the context of the request once its response is
+// closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+func (c *GitlabNetClient) doRequest(ctx context.Context, method, path string, data interface{}) (*http.Response, error) {
 	request, correlationID, err := newRequest(ctx, method, c.httpClient.Host, path, data)
 	if err != nil {
 		return nil, err
@@ -126,12 +238,21 @@ func (c *GitlabNetClient) DoRequest(ctx context.Context, method, path string, da
 		request.SetBasicAuth(user, password)
 	}
 
-	encodedSecret := base64.StdEncoding.EncodeToString([]byte(c.secret))
-	request.Header.Set(secretHeaderName, encodedSecret)
+	if c.secretAuth != JWTOnly {
+		encodedSecret := base64.StdEncoding.EncodeToString([]byte(c.secret))
+		request.Header.Set(secretHeaderName, encodedSecret)
+	}
+
+	if c.secretAuth != SecretHeader {
+		token, err := signJWT(c.secret, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set(JWTHeaderName, token)
+	}
 
 	request.Header.Add("Content-Type", "application/json")
 	request.Header.Add("User-Agent", c.userAgent)
-	request.Close = true
 
 	start := time.Now()
 	response, err := c.httpClient.Do(request)
@@ -145,7 +266,7 @@ func (c *GitlabNetClient) DoRequest(ctx context.Context, method, path string, da
 
 	if err != nil {
 		logger.WithError(err).Error("Internal API unreachable")
-		return nil, fmt.Errorf("Internal API unreachable")
+		return nil, &unreachableError{err: err}
 	}
 
 	if response != nil {
@@ -22,6 +22,14 @@ const (
 	httpProtocol              = "http://"
 	httpsProtocol             = "https://"
 	defaultReadTimeoutSeconds = 300
+
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 100
+	defaultIdleConnTimeout     = 90 * time.Second
+
+	defaultDialTimeout         = 10 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	keepAliveInterval          = 30 * time.Second
 )
 
 type HttpClient struct {
@@ -32,6 +40,14 @@ type HttpClient struct {
 type httpClientCfg struct {
 	keyPath, certPath string
 	caFile, caPath    string
+
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
 }
 
 func (hcc httpClientCfg) HaveCertAndKey() bool { return hcc.keyPath != "" && hcc.certPath != "" }
@@ -48,6 +64,29 @@ func WithClientCert(certPath, keyPath string) HTTPClientOpt {
 	}
 }
 
+// WithIdleConnections configures how many connections are kept open for
+// subsequent requests, in total and to the GitLab host, and for how long. The
+// defaults are used for zero values.
+func WithIdleConnections(maxIdleConns, maxIdleConnsPerHost int, idleConnTimeout time.Duration) HTTPClientOpt {
+	return func(hcc *httpClientCfg) {
+		hcc.maxIdleConns = maxIdleConns
+		hcc.maxIdleConnsPerHost = maxIdleConnsPerHost
+		hcc.idleConnTimeout = idleConnTimeout
+	}
+}
+
+// WithTimeouts configures the time allowed to connect to GitLab, to complete
+// the TLS handshake, and to receive the headers of a response once the request
+// is sent. The defaults are used for zero values, and the time to receive the
+// headers is only limited by the read timeout by default.
+func WithTimeouts(dialTimeout, tlsHandshakeTimeout, responseHeaderTimeout time.Duration) HTTPClientOpt {
+	return func(hcc *httpClientCfg) {
+		hcc.dialTimeout = dialTimeout
+		hcc.tlsHandshakeTimeout = tlsHandshakeTimeout
+		hcc.responseHeaderTimeout = responseHeaderTimeout
+	}
+}
+
 // Deprecated: use NewHTTPClientWithOpts - https://gitlab.com/gitlab-org/gitlab-shell/-/issues/484
 func NewHTTPClient(gitlabURL, gitlabRelativeURLRoot, caFile, caPath string, selfSignedCert bool, readTimeoutSeconds uint64) *HttpClient {
 	c, err := NewHTTPClientWithOpts(gitlabURL, gitlabRelativeURLRoot, caFile, caPath, selfSignedCert, readTimeoutSeconds, nil)
@@ -57,7 +96,9 @@ func NewHTTPClient(gitlabURL, gitlabRelativeURLRoot, caFile, caPath string, self
 	return c
 }
 
-// NewHTTPClientWithOpts builds an HTTP client using the provided options
+// NewHTTPClientWithOpts builds an HTTP client using the provided options. The
+// connections are kept alive and reused, so the client should be shared by all
+// the requests to the same GitLab instance. It's safe for concurrent use.
 func NewHTTPClientWithOpts(gitlabURL, gitlabRelativeURLRoot, caFile, caPath string, selfSignedCert bool, readTimeoutSeconds uint64, opts []HTTPClientOpt) (*HttpClient, error) {
 	hcc := &httpClientCfg{
 		caFile: caFile,
@@ -68,11 +109,16 @@ func NewHTTPClientWithOpts(gitlabURL, gitlabRelativeURLRoot, caFile, caPath stri
 		opt(hcc)
 	}
 
+	dialer := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: keepAliveInterval}
+	if hcc.dialTimeout > 0 {
+		dialer.Timeout = hcc.dialTimeout
+	}
+
 	var transport *http.Transport
 	var host string
 	var err error
 	if strings.HasPrefix(gitlabURL, unixSocketProtocol) {
-		transport, host = buildSocketTransport(gitlabURL, gitlabRelativeURLRoot)
+		transport, host = buildSocketTransport(gitlabURL, gitlabRelativeURLRoot, dialer)
 	} else if strings.HasPrefix(gitlabURL, httpProtocol) {
 		transport, host = buildHttpTransport(gitlabURL)
 	} else if strings.HasPrefix(gitlabURL, httpsProtocol) {
@@ -84,6 +130,12 @@ func NewHTTPClientWithOpts(gitlabURL, gitlabRelativeURLRoot, caFile, caPath stri
 		return nil, errors.New("unknown GitLab URL prefix")
 	}
 
+	if transport.DialContext == nil {
+		transport.DialContext = dialer.DialContext
+	}
+	configureIdleConnections(transport, *hcc)
+	configureTimeouts(transport, *hcc)
+
 	c := &http.Client{
 		Transport: correlation.NewInstrumentedRoundTripper(transport),
 		Timeout:   readTimeout(readTimeoutSeconds),
@@ -94,12 +146,11 @@ func NewHTTPClientWithOpts(gitlabURL, gitlabRelativeURLRoot, caFile, caPath stri
 	return client, nil
 }
 
-func buildSocketTransport(gitlabURL, gitlabRelativeURLRoot string) (*http.Transport, string) {
+func buildSocketTransport(gitlabURL, gitlabRelativeURLRoot string, dialer *net.Dialer) (*http.Transport, string) {
 	socketPath := strings.TrimPrefix(gitlabURL, unixSocketProtocol)
 
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
-			dialer := net.Dialer{}
 			return dialer.DialContext(ctx, "unix", socketPath)
 		},
 	}
@@ -167,6 +218,32 @@ func buildHttpTransport(gitlabURL string) (*http.Transport, string) {
 	return &http.Transport{}, gitlabURL
 }
 
+func configureIdleConnections(transport *http.Transport, hcc httpClientCfg) {
+	transport.MaxIdleConns = defaultMaxIdleConns
+	if hcc.maxIdleConns > 0 {
+		transport.MaxIdleConns = hcc.maxIdleConns
+	}
+
+	transport.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	if hcc.maxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = hcc.maxIdleConnsPerHost
+	}
+
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+	if hcc.idleConnTimeout > 0 {
+		transport.IdleConnTimeout = hcc.idleConnTimeout
+	}
+}
+
+func configureTimeouts(transport *http.Transport, hcc httpClientCfg) {
+	transport.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	if hcc.tlsHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = hcc.tlsHandshakeTimeout
+	}
+
+	transport.ResponseHeaderTimeout = hcc.responseHeaderTimeout
+}
+
 func readTimeout(timeoutSeconds uint64) time.Duration {
 	if timeoutSeconds == 0 {
 		timeoutSeconds = defaultReadTimeoutSeconds
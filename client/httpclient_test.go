@@ -5,8 +5,11 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -129,3 +132,127 @@ func setup(t *testing.T, username, password string, requests []testserver.TestRe
 
 	return client
 }
+
+func TestConnectionReuse(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	httpClient, err := NewHTTPClientWithOpts(server.URL, "", "", "", false, 1, []HTTPClientOpt{WithIdleConnections(0, 0, time.Minute)})
+	require.NoError(t, err)
+
+	client, err := NewGitlabNetClient("", "", "", httpClient)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		response, err := client.Get(context.Background(), "/check")
+		require.NoError(t, err)
+
+		_, err = ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		require.NoError(t, response.Body.Close())
+	}
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
+
+func TestIdleConnectionsSettings(t *testing.T) {
+	transport := &http.Transport{}
+	configureIdleConnections(transport, httpClientCfg{})
+
+	require.Equal(t, defaultMaxIdleConns, transport.MaxIdleConns)
+	require.Equal(t, defaultMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	require.Equal(t, defaultIdleConnTimeout, transport.IdleConnTimeout)
+
+	hcc := httpClientCfg{}
+	WithIdleConnections(10, 5, time.Minute)(&hcc)
+	configureIdleConnections(transport, hcc)
+
+	require.Equal(t, 10, transport.MaxIdleConns)
+	require.Equal(t, 5, transport.MaxIdleConnsPerHost)
+	require.Equal(t, time.Minute, transport.IdleConnTimeout)
+}
+
+func TestTimeoutsSettings(t *testing.T) {
+	transport := &http.Transport{}
+	configureTimeouts(transport, httpClientCfg{})
+
+	require.Equal(t, defaultTLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	require.Zero(t, transport.ResponseHeaderTimeout)
+
+	hcc := httpClientCfg{}
+	WithTimeouts(time.Second, 2*time.Second, 3*time.Second)(&hcc)
+	configureTimeouts(transport, hcc)
+
+	require.Equal(t, time.Second, hcc.dialTimeout)
+	require.Equal(t, 2*time.Second, transport.TLSHandshakeTimeout)
+	require.Equal(t, 3*time.Second, transport.ResponseHeaderTimeout)
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	url := testserver.StartHttpServer(t, []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/slow",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(500 * time.Millisecond)
+			},
+		},
+	})
+
+	httpClient, err := NewHTTPClientWithOpts(url, "", "", "", false, 1, []HTTPClientOpt{WithTimeouts(0, 0, 50*time.Millisecond)})
+	require.NoError(t, err)
+
+	client, err := NewGitlabNetClient("", "", "", httpClient)
+	require.NoError(t, err)
+
+	_, err = client.Get(context.Background(), "/slow")
+	require.EqualError(t, err, "Internal API unreachable")
+}
+
+func TestEndpointTimeouts(t *testing.T) {
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/slow",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(500 * time.Millisecond)
+				fmt.Fprint(w, "Slow")
+			},
+		},
+		{
+			Path: "/api/v4/internal/fast",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "Fast")
+			},
+		},
+	}
+
+	client := setup(t, "", "", requests)
+	client.SetEndpointTimeouts(map[string]time.Duration{
+		"/slow": 50 * time.Millisecond,
+		"/fast": time.Second,
+	})
+
+	_, err := client.Get(context.Background(), "/slow?key=value")
+	require.EqualError(t, err, "Internal API unreachable")
+
+	// The response is read with the context of the request
+	response, err := client.Get(context.Background(), "/fast")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	require.Equal(t, "Fast", string(body))
+
+	client.SetEndpointTimeouts(nil)
+	response, err = client.Get(context.Background(), "/slow")
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+}
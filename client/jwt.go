@@ -0,0 +1,64 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	// JWTHeaderName is the header of the JWT signed with the shared secret.
+	JWTHeaderName = "Gitlab-Shell-Api-Request"
+	// JWTIssuer is the issuer claim of the JWT.
+	JWTIssuer = "gitlab-shell"
+
+	jwtTTL = time.Minute
+)
+
+// SecretAuth is how the requests prove that they know the shared secret.
+type SecretAuth int
+
+const (
+	// SecretHeader sends the shared secret in the Gitlab-Shared-Secret header.
+	SecretHeader SecretAuth = iota
+	// SecretHeaderAndJWT also sends a short-lived JWT signed with the secret,
+	// for the GitLab versions that verify it.
+	SecretHeaderAndJWT
+	// JWTOnly only sends the JWT, so that a request can't be replayed once it
+	// expired.
+	JWTOnly
+)
+
+type jwtClaims struct {
+	Issuer    string `json:"iss"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// signJWT returns an HS256 JWT issued at now. Like GitLab, the surrounding
+// whitespace of the secret read from a file is ignored.
+func signJWT(secret string, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(jwtClaims{
+		Issuer:    JWTIssuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(jwtTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	mac := hmac.New(sha256.New, []byte(strings.TrimSpace(secret)))
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+)
+
+const jwtSecret = "sssh, it's a secret\n"
+
+func TestSignJWT(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		secret        string
+		issuedAt      time.Time
+		expectedError string
+	}{
+		{
+			desc:     "valid token",
+			secret:   jwtSecret,
+			issuedAt: time.Now(),
+		},
+		{
+			desc:          "wrong secret",
+			secret:        "wrong",
+			issuedAt:      time.Now(),
+			expectedError: "invalid JWT signature",
+		},
+		{
+			desc:          "expired token",
+			secret:        jwtSecret,
+			issuedAt:      time.Now().Add(-2 * jwtTTL),
+			expectedError: "expired JWT",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			token, err := signJWT(tc.secret, tc.issuedAt)
+			require.NoError(t, err)
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v4/internal/check", nil)
+			r.Header.Set(JWTHeaderName, token)
+
+			err = testserver.VerifyJWT(r, jwtSecret)
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestSecretAuth(t *testing.T) {
+	var sharedSecret string
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/jwt",
+			Handler: testserver.RequireJWT(jwtSecret, func(w http.ResponseWriter, r *http.Request) {
+				sharedSecret = r.Header.Get(secretHeaderName)
+			}),
+		},
+	}
+
+	testCases := []struct {
+		desc                 string
+		auth                 SecretAuth
+		expectedError        string
+		expectedSharedSecret string
+	}{
+		{
+			desc:          "secret header",
+			auth:          SecretHeader,
+			expectedError: "no JWT",
+		},
+		{
+			desc:                 "secret header and JWT",
+			auth:                 SecretHeaderAndJWT,
+			expectedSharedSecret: base64.StdEncoding.EncodeToString([]byte(jwtSecret)),
+		},
+		{
+			desc: "JWT only",
+			auth: JWTOnly,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			sharedSecret = ""
+
+			client := setup(t, "", "", requests)
+			client.secret = jwtSecret
+			client.SetSecretAuth(tc.auth)
+
+			response, err := client.Get(context.Background(), "/jwt")
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			response.Body.Close()
+			require.Equal(t, tc.expectedSharedSecret, sharedSecret)
+		})
+	}
+}
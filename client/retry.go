@@ -0,0 +1,234 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "gitlab_shell"
+	metricsSubsystem = "api"
+
+	breakerStateClosed   = 0
+	breakerStateOpen     = 1
+	breakerStateHalfOpen = 2
+)
+
+var (
+	apiRequestAttempts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "request_attempts_total",
+			Help:      "The number of attempts to send a request to the internal API, by method and endpoint.",
+		},
+		[]string{"method", "endpoint"},
+	)
+
+	apiRequestRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "request_retries_total",
+			Help:      "The number of requests to the internal API sent again after a transient error, by method and endpoint.",
+		},
+		[]string{"method", "endpoint"},
+	)
+
+	apiCircuitBreakerState = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "circuit_breaker_state",
+			Help:      "The state of the circuit breaker of the internal API: 0 when closed, 1 when open and 2 when half-open.",
+		},
+	)
+
+	apiCircuitBreakerRejections = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "circuit_breaker_rejected_requests_total",
+			Help:      "The number of requests to the internal API failed without being sent because the circuit breaker was open.",
+		},
+	)
+)
+
+// RetryPolicy configures how requests failing with a transient error are sent
+// again. Requests that may change something are only sent again when the
+// connection was refused.
+type RetryPolicy struct {
+	// Retries is the number of times a request is sent again. Zero disables
+	// the retries.
+	Retries int
+	// The delay before a retry is chosen randomly up to MinBackoff, doubled
+	// after each retry, and at most MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.MinBackoff
+	for i := 0; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+// unreachableError is returned when a request couldn't be sent or no response
+// was received.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return "Internal API unreachable"
+}
+
+func (e *unreachableError) Unwrap() error {
+	return e.err
+}
+
+// IsUnavailable reports whether a request failed because the internal API
+// couldn't answer it, like when GitLab is restarting, rather than because of
+// the answer of GitLab.
+func IsUnavailable(err error) bool {
+	var unreachable *unreachableError
+	if errors.As(err, &unreachable) {
+		return true
+	}
+
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+
+	return false
+}
+
+// shouldRetry reports whether a request that failed with err can be sent
+// again without side effects.
+func shouldRetry(method string, err error) bool {
+	if method == http.MethodGet || method == http.MethodHead {
+		return IsUnavailable(err)
+	}
+
+	// The request was never received by the server.
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func endpointLabel(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+
+	return strings.TrimPrefix(path, internalApiPath)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CircuitBreaker makes the requests fail without being sent while the internal
+// API is unavailable. It opens after a number of consecutive requests failed
+// because the API was unavailable, and lets one request through every cooldown
+// period until one succeeds. It's safe for concurrent use, and should be
+// shared by all the clients of the same API.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	// The time the breaker opened or let the last request through.
+	openedAt time.Time
+}
+
+// NewCircuitBreaker returns nil, which never opens, when threshold is zero.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a request can be sent.
+func (b *CircuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerStateClosed {
+		return true
+	}
+
+	now := b.now()
+	if now.Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+
+	b.openedAt = now
+	b.setState(breakerStateHalfOpen)
+
+	return true
+}
+
+// record records whether a request failed because the API was unavailable.
+func (b *CircuitBreaker) record(unavailable bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !unavailable {
+		b.failures = 0
+		b.setState(breakerStateClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerStateHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(breakerStateOpen)
+	}
+}
+
+func (b *CircuitBreaker) setState(state int) {
+	b.state = state
+	apiCircuitBreakerState.Set(float64(state))
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	for retry, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 100; i++ {
+			backoff := policy.backoff(retry)
+			require.True(t, backoff > 0 && backoff <= max, "backoff %v of retry %d", backoff, retry)
+		}
+	}
+
+	require.Equal(t, time.Duration(0), RetryPolicy{}.backoff(0))
+}
+
+func TestRetries(t *testing.T) {
+	var getAttempts, postAttempts int32
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/flaky",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&getAttempts, 1) <= 2 {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.Write([]byte("OK"))
+			},
+		},
+		{
+			Path: "/api/v4/internal/unavailable",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&postAttempts, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		},
+	}
+
+	client := setup(t, "", "", requests)
+	client.SetRetryPolicy(RetryPolicy{Retries: 2, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+
+	retries := apiRequestRetries.WithLabelValues(http.MethodGet, "/flaky")
+	retriesBefore := testutil.ToFloat64(retries)
+
+	response, err := client.Get(context.Background(), "/flaky")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, int32(3), atomic.LoadInt32(&getAttempts))
+	require.Equal(t, retriesBefore+2, testutil.ToFloat64(retries))
+
+	// Requests that may change something aren't sent again once received
+	_, err = client.Post(context.Background(), "/unavailable", nil)
+	require.EqualError(t, err, "Internal API error (503)")
+	require.Equal(t, int32(1), atomic.LoadInt32(&postAttempts))
+}
+
+func TestRetriesConnectionRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	url := "http://" + listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	client, err := NewGitlabNetClient("", "", "", NewHTTPClient(url, "", "", "", false, 1))
+	require.NoError(t, err)
+	client.SetRetryPolicy(RetryPolicy{Retries: 2, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+
+	attempts := apiRequestAttempts.WithLabelValues(http.MethodPost, "/allowed")
+	attemptsBefore := testutil.ToFloat64(attempts)
+
+	_, err = client.Post(context.Background(), "/allowed", nil)
+	require.EqualError(t, err, "Internal API unreachable")
+	require.Equal(t, attemptsBefore+3, testutil.ToFloat64(attempts))
+}
+
+func TestRetriesWithinEndpointTimeout(t *testing.T) {
+	var attempts int32
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/slow",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				time.Sleep(150 * time.Millisecond)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		},
+	}
+
+	client := setup(t, "", "", requests)
+	client.SetRetryPolicy(RetryPolicy{Retries: 10, MinBackoff: 100 * time.Millisecond, MaxBackoff: 100 * time.Millisecond})
+	client.SetEndpointTimeouts(map[string]time.Duration{"/slow": 500 * time.Millisecond})
+
+	// The timeout covers all the attempts, not each of them
+	start := time.Now()
+	_, err := client.Get(context.Background(), "/slow")
+	require.Error(t, err)
+	require.True(t, time.Since(start) < time.Second, "the request took %v", time.Since(start))
+	require.True(t, atomic.LoadInt32(&attempts) < 4, "%d attempts were made", atomic.LoadInt32(&attempts))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	require.Nil(t, NewCircuitBreaker(0, time.Second))
+
+	now := time.Now()
+	breaker := NewCircuitBreaker(2, 10*time.Second)
+	breaker.now = func() time.Time { return now }
+
+	breaker.record(true)
+	breaker.record(false)
+	breaker.record(true)
+	require.True(t, breaker.allow(), "the failures must be consecutive")
+
+	breaker.record(true)
+	require.False(t, breaker.allow())
+	require.Equal(t, float64(breakerStateOpen), testutil.ToFloat64(apiCircuitBreakerState))
+
+	// One request is let through after the cooldown
+	now = now.Add(10 * time.Second)
+	require.True(t, breaker.allow())
+	require.False(t, breaker.allow())
+	require.Equal(t, float64(breakerStateHalfOpen), testutil.ToFloat64(apiCircuitBreakerState))
+
+	breaker.record(true)
+	now = now.Add(5 * time.Second)
+	require.False(t, breaker.allow())
+
+	now = now.Add(5 * time.Second)
+	require.True(t, breaker.allow())
+	breaker.record(false)
+	require.True(t, breaker.allow())
+	require.Equal(t, float64(breakerStateClosed), testutil.ToFloat64(apiCircuitBreakerState))
+}
+
+func TestCircuitBreakerRejectsRequests(t *testing.T) {
+	var attempts int32
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/unavailable",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+		},
+		{
+			Path: "/api/v4/internal/missing",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(http.StatusNotFound)
+			},
+		},
+	}
+
+	client := setup(t, "", "", requests)
+	client.SetCircuitBreaker(NewCircuitBreaker(2, time.Minute))
+
+	// Errors returned by the API don't open the breaker
+	for i := 0; i < 3; i++ {
+		_, err := client.Get(context.Background(), "/missing")
+		require.EqualError(t, err, "Internal API error (404)")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Get(context.Background(), "/unavailable")
+		require.EqualError(t, err, "Internal API error (503)")
+	}
+
+	rejectionsBefore := testutil.ToFloat64(apiCircuitBreakerRejections)
+
+	_, err := client.Get(context.Background(), "/missing")
+	require.EqualError(t, err, "Internal API unreachable")
+	require.Equal(t, int32(5), atomic.LoadInt32(&attempts))
+	require.Equal(t, rejectionsBefore+1, testutil.ToFloat64(apiCircuitBreakerRejections))
+}
@@ -0,0 +1,102 @@
+package testserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	jwtHeaderName = "Gitlab-Shell-Api-Request"
+	jwtIssuer     = "gitlab-shell"
+)
+
+// VerifyJWT checks the JWT sent with a request to the internal API, the way
+// GitLab does: it must be signed with secret using HS256, issued by
+// gitlab-shell and not expired.
+func VerifyJWT(r *http.Request, secret string) error {
+	token := r.Header.Get(jwtHeaderName)
+	if token == "" {
+		return errors.New("no JWT")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed JWT")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Algorithm != "HS256" {
+		return fmt.Errorf("unexpected JWT algorithm %q", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed JWT signature: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(strings.TrimSpace(secret)))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("invalid JWT signature")
+	}
+
+	var claims struct {
+		Issuer    string `json:"iss"`
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	switch {
+	case claims.Issuer != jwtIssuer:
+		return fmt.Errorf("unexpected JWT issuer %q", claims.Issuer)
+	case claims.IssuedAt > now:
+		return errors.New("JWT issued in the future")
+	case claims.ExpiresAt <= now:
+		return errors.New("expired JWT")
+	}
+
+	return nil
+}
+
+// RequireJWT wraps a handler so that the requests without a valid JWT are
+// rejected with 401 Unauthorized.
+func RequireJWT(secret string, handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := VerifyJWT(r, secret); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed JWT: %w", err)
+	}
+
+	if err := json.Unmarshal(decoded, v); err != nil {
+		return fmt.Errorf("malformed JWT: %w", err)
+	}
+
+	return nil
+}
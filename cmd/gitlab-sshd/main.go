@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -10,6 +14,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-shell/internal/logger"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/sshd"
 	"gitlab.com/gitlab-org/labkit/monitoring"
+	"gitlab.com/gitlab-org/labkit/tracing"
 )
 
 var (
@@ -37,6 +42,26 @@ func overrideConfigFromEnvironment(cfg *config.Config) {
 	return
 }
 
+// reloadKeys reads the configuration file again, so that the changes to the
+// host key files and trusted user CA keys apply, and reloads the keys. The
+// current keys and settings are kept if the configuration isn't valid.
+func reloadKeys(server *sshd.Server) error {
+	if *configDir == "" {
+		return server.Reload()
+	}
+
+	cfg, err := config.NewFromDir(*configDir)
+	if err != nil {
+		return err
+	}
+	overrideConfigFromEnvironment(cfg)
+	if err := cfg.IsSane(); err != nil {
+		return err
+	}
+
+	return server.ReloadConfig(cfg)
+}
+
 func main() {
 	flag.Parse()
 	cfg := new(config.Config)
@@ -56,19 +81,96 @@ func main() {
 	}
 	logger.ConfigureStandalone(cfg)
 
+	// Each connection and session gets a tracing span
+	closer := tracing.Initialize(
+		tracing.WithServiceName("gitlab-sshd"),
+		tracing.WithConnectionString(cfg.GitlabTracing),
+	)
+	defer closer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := sshd.NewServer(cfg)
+
 	// Startup monitoring endpoint.
 	if cfg.Server.WebListen != "" {
+		webListener, err := server.ListenMonitoring()
+		if err != nil {
+			log.Fatalf("Failed to listen on %v: %v", cfg.Server.WebListen, err)
+		}
+
 		go func() {
-			log.Fatal(
-				monitoring.Start(
-					monitoring.WithListenerAddress(cfg.Server.WebListen),
-					monitoring.WithBuildInformation(Version, BuildTime),
-				),
+			err := monitoring.Start(
+				monitoring.WithListener(webListener),
+				monitoring.WithBuildInformation(Version, BuildTime),
+				monitoring.WithServeMux(server.MonitoringServeMux()),
 			)
+			// The new process serves the monitoring endpoint after an upgrade
+			if err == sshd.ErrHandedOver {
+				log.Info("Monitoring endpoint handed over to the new process")
+				return
+			}
+
+			log.Fatal(err)
 		}()
 	}
 
-	if err := sshd.Run(cfg); err != nil {
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+
+		for range reload {
+			log.Info("Reloading keys")
+
+			if err := reloadKeys(server); err != nil {
+				log.WithError(err).Error("Failed to reload keys, keeping the current ones")
+			}
+		}
+	}()
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
+
+	// On SIGUSR2, a new process is started from the binary on disk and takes
+	// over the listening sockets. This process then shuts down like on SIGTERM.
+	go func() {
+		upgrade := make(chan os.Signal, 1)
+		signal.Notify(upgrade, syscall.SIGUSR2)
+
+		for sig := range upgrade {
+			log.Info("Upgrade initiated")
+
+			if err := server.Upgrade(); err != nil {
+				log.WithError(err).Error("Upgrade failed, keeping the current process")
+				continue
+			}
+
+			log.Info("Upgrade finished, the new process accepts connections")
+
+			select {
+			case done <- sig:
+			default:
+			}
+		}
+	}()
+
+	go func() {
+		sig := <-done
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+
+		gracePeriod := cfg.Server.GracePeriod()
+		log.WithFields(log.Fields{"shutdown_timeout_s": gracePeriod.Seconds(), "signal": sig.String()}).Info("Shutdown initiated")
+
+		server.Shutdown()
+
+		<-time.After(gracePeriod)
+		cancel()
+	}()
+
+	if err := server.ListenAndServe(ctx); err != nil {
 		log.Fatalf("Failed to start GitLab built-in sshd: %v", err)
 	}
+
+	log.Info("Shutdown finished")
 }
@@ -31,6 +31,9 @@ type Shell struct {
 	SshArgs        []string
 	CommandType    CommandType
 	Env            sshenv.Env
+	// The SSH login name used by the client, and the access it gives.
+	SSHUser       string
+	SSHUserAccess string
 }
 
 func (s *Shell) Parse() error {
@@ -13,6 +13,10 @@ import (
 
 type Response = accessverifier.Response
 
+const deployKeyType = "deploy_key"
+
+var errDeployKeysOnly = errors.New("Only deploy keys are accepted for this SSH user")
+
 type Command struct {
 	Config     *config.Config
 	Args       *commandargs.Shell
@@ -36,6 +40,10 @@ func (c *Command) Verify(ctx context.Context, action commandargs.CommandType, re
 		return nil, errors.New(response.Message)
 	}
 
+	if c.Args.SSHUserAccess == config.SSHUserAccessDeployKeys && response.KeyType != deployKeyType {
+		return nil, errDeployKeysOnly
+	}
+
 	return response, nil
 }
 
@@ -34,12 +34,19 @@ func setup(t *testing.T) (*Command, *bytes.Buffer, *bytes.Buffer) {
 				err = json.Unmarshal(b, &requestBody)
 				require.NoError(t, err)
 
-				if requestBody.KeyId == "1" {
+				switch requestBody.KeyId {
+				case "1":
 					body := map[string]interface{}{
 						"gl_console_messages": []string{"console", "message"},
 					}
 					require.NoError(t, json.NewEncoder(w).Encode(body))
-				} else {
+				case "3":
+					body := map[string]interface{}{"status": true, "gl_key_type": "key"}
+					require.NoError(t, json.NewEncoder(w).Encode(body))
+				case "4":
+					body := map[string]interface{}{"status": true, "gl_key_type": "deploy_key"}
+					require.NoError(t, json.NewEncoder(w).Encode(body))
+				default:
 					body := map[string]interface{}{
 						"status":  false,
 						"message": "missing user",
@@ -79,3 +86,40 @@ func TestConsoleMessages(t *testing.T) {
 	require.Equal(t, "remote: \nremote: console\nremote: message\nremote: \n", errBuf.String())
 	require.Empty(t, outBuf.String())
 }
+
+func TestDeployKeysOnlyUser(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		args          *commandargs.Shell
+		expectedError string
+	}{
+		{
+			desc: "user key with any access",
+			args: &commandargs.Shell{GitlabKeyId: "3", SSHUserAccess: config.SSHUserAccessAll},
+		},
+		{
+			desc:          "user key with deploy keys access",
+			args:          &commandargs.Shell{GitlabKeyId: "3", SSHUserAccess: config.SSHUserAccessDeployKeys},
+			expectedError: "Only deploy keys are accepted for this SSH user",
+		},
+		{
+			desc: "deploy key with deploy keys access",
+			args: &commandargs.Shell{GitlabKeyId: "4", SSHUserAccess: config.SSHUserAccessDeployKeys},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cmd, _, _ := setup(t)
+
+			cmd.Args = tc.args
+			_, err := cmd.Verify(context.Background(), action, repo)
+
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
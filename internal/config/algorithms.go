@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The algorithms implemented by golang.org/x/crypto/ssh. Weak algorithms are
+// left out on purpose, so that they can't be enabled by mistake.
+var (
+	supportedCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+	}
+
+	supportedKexAlgorithms = []string{
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha1",
+	}
+
+	supportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1",
+	}
+
+	// DSA keys are always rejected and aren't part of this list.
+	supportedPublicKeyAlgorithms = []string{
+		ssh.KeyAlgoRSA,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoSKECDSA256,
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoSKED25519,
+	}
+)
+
+func (sc *ServerConfig) checkAlgorithms() error {
+	lists := []struct {
+		name       string
+		configured []string
+		supported  []string
+	}{
+		{"sshd.ciphers", sc.Ciphers, supportedCiphers},
+		{"sshd.kex_algorithms", sc.KexAlgorithms, supportedKexAlgorithms},
+		{"sshd.macs", sc.MACs, supportedMACs},
+		{"sshd.public_key_algorithms", sc.PublicKeyAlgorithms, supportedPublicKeyAlgorithms},
+	}
+
+	for _, list := range lists {
+		for _, algorithm := range list.configured {
+			if !contains(list.supported, algorithm) {
+				return fmt.Errorf("%v: unsupported algorithm %q, must be one of %q", list.name, algorithm, list.supported)
+			}
+		}
+	}
+
+	if sc.MinRSAKeySize < 0 {
+		return errors.New("sshd.min_rsa_key_size must not be negative")
+	}
+
+	return nil
+}
+
+// PublicKeyAlgorithmAllowed reports whether users may authenticate with a key
+// of the given type. All supported algorithms are allowed when the list isn't
+// configured.
+func (sc *ServerConfig) PublicKeyAlgorithmAllowed(algorithm string) bool {
+	if len(sc.PublicKeyAlgorithms) == 0 {
+		return contains(supportedPublicKeyAlgorithms, algorithm)
+	}
+
+	return contains(sc.PublicKeyAlgorithms, algorithm)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
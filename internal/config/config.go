@@ -1,11 +1,19 @@
 package config
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 
 	"gitlab.com/gitlab-org/gitlab-shell/client"
 	yaml "gopkg.in/yaml.v2"
@@ -14,22 +22,118 @@ import (
 const (
 	configFile            = "config.yml"
 	defaultSecretFileName = ".gitlab_shell_secret"
+
+	defaultListenerName    = "default"
+	defaultListenerNetwork = "tcp"
 )
 
+// MonitoringListenerName is the name of the socket of web_listen when it's
+// passed to another process. It can't be used by the SSH listeners.
+const MonitoringListenerName = "monitoring"
+
 type ServerConfig struct {
-	Listen                  string   `yaml:"listen,omitempty"`
-	WebListen               string   `yaml:"web_listen,omitempty"`
-	ConcurrentSessionsLimit int64    `yaml:"concurrent_sessions_limit,omitempty"`
-	HostKeyFiles            []string `yaml:"host_key_files,omitempty"`
+	Listen                     string           `yaml:"listen,omitempty"`
+	WebListen                  string           `yaml:"web_listen,omitempty"`
+	ConcurrentSessionsLimit    int64            `yaml:"concurrent_sessions_limit,omitempty"`
+	HostKeyFiles               []string         `yaml:"host_key_files,omitempty"`
+	GracePeriodSeconds         uint64           `yaml:"grace_period"`
+	TrustedUserCAKeys          string           `yaml:"trusted_user_ca_keys,omitempty"`
+	AuthorizedPrincipals       []string         `yaml:"authorized_principals,omitempty"`
+	ProxyProtocol              bool             `yaml:"proxy_protocol,omitempty"`
+	ProxyPolicy                string           `yaml:"proxy_policy,omitempty"`
+	ProxyAllowed               []string         `yaml:"proxy_allowed,omitempty"`
+	LoginGraceTimeSeconds      uint64           `yaml:"login_grace_time"`
+	ClientAliveIntervalSeconds uint64           `yaml:"client_alive_interval"`
+	ClientAliveCountMax        int              `yaml:"client_alive_count_max"`
+	IdleTimeoutSeconds         uint64           `yaml:"idle_timeout,omitempty"`
+	Ciphers                    []string         `yaml:"ciphers,omitempty"`
+	KexAlgorithms              []string         `yaml:"kex_algorithms,omitempty"`
+	MACs                       []string         `yaml:"macs,omitempty"`
+	PublicKeyAlgorithms        []string         `yaml:"public_key_algorithms,omitempty"`
+	MinRSAKeySize              int              `yaml:"min_rsa_key_size,omitempty"`
+	RequireOTP                 bool             `yaml:"require_otp,omitempty"`
+	InteractiveShell           bool             `yaml:"interactive_shell,omitempty"`
+	AcceptEnv                  []string         `yaml:"accept_env,omitempty"`
+	Listeners                  []ListenerConfig `yaml:"listeners,omitempty"`
+	Users                      []SSHUserConfig  `yaml:"users,omitempty"`
+	KeyCacheSize               int              `yaml:"key_cache_size,omitempty"`
+	KeyCacheTTLSeconds         uint64           `yaml:"key_cache_ttl"`
+	KeyCacheNegativeTTLSeconds uint64           `yaml:"key_cache_negative_ttl"`
+
+	ConnectionLimitsConfig `yaml:",inline"`
+}
+
+// How the requests to the internal API are authenticated with the secret.
+const (
+	// JWTAuthDisabled only sends the secret in the Gitlab-Shared-Secret header.
+	JWTAuthDisabled = "disabled"
+	// JWTAuthEnabled also sends a JWT signed with the secret.
+	JWTAuthEnabled = "enabled"
+	// JWTAuthOnly only sends the JWT, which requires a GitLab version verifying it.
+	JWTAuthOnly = "only"
+)
+
+// The access given by an SSH login name.
+const (
+	// SSHUserAccessAll gives access to all the commands, with any key.
+	SSHUserAccessAll = "all"
+	// SSHUserAccessDeployKeys only gives access to repositories with a deploy key.
+	SSHUserAccessDeployKeys = "deploy_keys"
+)
+
+// SSHUserConfig maps a login name accepted by the SSH server to the access it
+// gives.
+type SSHUserConfig struct {
+	Name   string `yaml:"name"`
+	Access string `yaml:"access,omitempty"`
+}
+
+// ListenerConfig configures one of the addresses the SSH server accepts
+// connections on.
+type ListenerConfig struct {
+	Name          string   `yaml:"name"`
+	Network       string   `yaml:"network,omitempty"`
+	Listen        string   `yaml:"listen"`
+	ProxyProtocol bool     `yaml:"proxy_protocol,omitempty"`
+	ProxyPolicy   string   `yaml:"proxy_policy,omitempty"`
+	ProxyAllowed  []string `yaml:"proxy_allowed,omitempty"`
+
+	ConnectionLimitsConfig `yaml:",inline"`
+}
+
+type ConnectionLimitsConfig struct {
+	MaxConnections        int64   `yaml:"max_connections,omitempty"`
+	MaxConnectionsPerIP   int64   `yaml:"max_connections_per_ip,omitempty"`
+	ConnectionRatePerIP   float64 `yaml:"connection_rate_per_ip,omitempty"`
+	ConnectionBurstPerIP  int64   `yaml:"connection_burst_per_ip,omitempty"`
+	MaxAuthFailuresPerIP  int64   `yaml:"max_auth_failures_per_ip,omitempty"`
+	AuthFailureBanSeconds uint64  `yaml:"auth_failure_ban,omitempty"`
 }
 
 type HttpSettingsConfig struct {
-	User               string `yaml:"user"`
-	Password           string `yaml:"password"`
-	ReadTimeoutSeconds uint64 `yaml:"read_timeout"`
-	CaFile             string `yaml:"ca_file"`
-	CaPath             string `yaml:"ca_path"`
-	SelfSignedCert     bool   `yaml:"self_signed_cert"`
+	User                          string `yaml:"user"`
+	Password                      string `yaml:"password"`
+	ReadTimeoutSeconds            uint64 `yaml:"read_timeout"`
+	CaFile                        string `yaml:"ca_file"`
+	CaPath                        string `yaml:"ca_path"`
+	ClientCert                    string `yaml:"client_cert"`
+	ClientKey                     string `yaml:"client_key"`
+	SelfSignedCert                bool   `yaml:"self_signed_cert"`
+	Retries                       int    `yaml:"retries"`
+	RetryMinBackoffMilliseconds   uint64 `yaml:"retry_min_backoff_ms"`
+	RetryMaxBackoffMilliseconds   uint64 `yaml:"retry_max_backoff_ms"`
+	CircuitBreakerThreshold       int    `yaml:"circuit_breaker_threshold"`
+	CircuitBreakerCooldownSeconds uint64 `yaml:"circuit_breaker_cooldown"`
+	MaxIdleConns                  int    `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost           int    `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeoutSeconds        uint64 `yaml:"idle_conn_timeout"`
+	JWTAuth                       string `yaml:"jwt_auth"`
+	DialTimeoutSeconds            uint64 `yaml:"dial_timeout"`
+	TLSHandshakeTimeoutSeconds    uint64 `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeoutSeconds  uint64 `yaml:"response_header_timeout"`
+	// EndpointTimeoutsSeconds overrides the timeout of some endpoints, given by
+	// their path relative to /api/v4/internal.
+	EndpointTimeoutsSeconds map[string]uint64 `yaml:"endpoint_timeouts"`
 }
 
 type Config struct {
@@ -41,27 +145,61 @@ type Config struct {
 	GitlabRelativeURLRoot string `yaml:"gitlab_relative_url_root"`
 	GitlabTracing         string `yaml:"gitlab_tracing"`
 	// SecretFilePath is only for parsing. Application code should always use Secret.
-	SecretFilePath string             `yaml:"secret_file"`
-	Secret         string             `yaml:"secret"`
-	SslCertDir     string             `yaml:"ssl_cert_dir"`
-	HttpSettings   HttpSettingsConfig `yaml:"http_settings"`
-	Server         ServerConfig       `yaml:"sshd"`
-	HttpClient     *client.HttpClient `-`
+	SecretFilePath string `yaml:"secret_file"`
+	Secret         string `yaml:"secret"`
+	SslCertDir     string `yaml:"ssl_cert_dir"`
+	// AuthFile is only read when the internal API is unreachable and
+	// AuthFileFallback is set.
+	AuthFile         string             `yaml:"auth_file,omitempty"`
+	AuthFileFallback bool               `yaml:"auth_file_fallback,omitempty"`
+	HttpSettings     HttpSettingsConfig `yaml:"http_settings"`
+	Server           ServerConfig       `yaml:"sshd"`
+	HttpClient       *client.HttpClient `yaml:"-"`
+
+	circuitBreaker *client.CircuitBreaker
 }
 
+// The timeouts of the endpoints of the internal API, unless overridden. They
+// cover the retries of a request. Key lookups are made during the SSH
+// handshake, so they can't take long.
+var defaultEndpointTimeouts = map[string]time.Duration{
+	"/authorized_keys": 10 * time.Second,
+}
+
+// httpClientMu protects the lazy initialization of the HTTP client and the
+// circuit breaker of the configs, which are shared by concurrent requests.
+// Config can't hold it since it's copied by value.
+var httpClientMu sync.Mutex
+
 // The defaults to apply before parsing the config file(s).
 var (
 	DefaultConfig = Config{
-		LogFile: "gitlab-shell.log",
+		LogFile:   "gitlab-shell.log",
 		LogFormat: "text",
-		Server: DefaultServerConfig,
-		User: "git",
+		Server:    DefaultServerConfig,
+		User:      "git",
+		HttpSettings: HttpSettingsConfig{
+			Retries:                       2,
+			RetryMinBackoffMilliseconds:   100,
+			RetryMaxBackoffMilliseconds:   2000,
+			CircuitBreakerThreshold:       10,
+			CircuitBreakerCooldownSeconds: 10,
+		},
 	}
 
 	DefaultServerConfig = ServerConfig{
-		Listen: "[::]:22",
-		WebListen: "localhost:9122",
-		ConcurrentSessionsLimit: 10,
+		Listen:                     "[::]:22",
+		WebListen:                  "localhost:9122",
+		ConcurrentSessionsLimit:    10,
+		GracePeriodSeconds:         10,
+		LoginGraceTimeSeconds:      60,
+		ClientAliveIntervalSeconds: 15,
+		ClientAliveCountMax:        3,
+		KeyCacheTTLSeconds:         60,
+		KeyCacheNegativeTTLSeconds: 10,
+		ConnectionLimitsConfig: ConnectionLimitsConfig{
+			AuthFailureBanSeconds: 300,
+		},
 		HostKeyFiles: []string{
 			"/run/secrets/ssh-hostkeys/ssh_host_rsa_key",
 			"/run/secrets/ssh-hostkeys/ssh_host_ecdsa_key",
@@ -70,22 +208,313 @@ var (
 	}
 )
 
+// GracePeriod returns the time the server waits for active sessions to finish on shutdown.
+func (sc *ServerConfig) GracePeriod() time.Duration {
+	return time.Duration(sc.GracePeriodSeconds) * time.Second
+}
+
+// LoginGraceTime returns the time a client has to send the PROXY header, complete
+// the handshake and authenticate.
+func (sc *ServerConfig) LoginGraceTime() time.Duration {
+	return time.Duration(sc.LoginGraceTimeSeconds) * time.Second
+}
+
+// ClientAliveInterval returns how often the server checks that an idle client is still alive.
+func (sc *ServerConfig) ClientAliveInterval() time.Duration {
+	return time.Duration(sc.ClientAliveIntervalSeconds) * time.Second
+}
+
+// IdleTimeout returns the time after which a session without any activity is closed.
+func (sc *ServerConfig) IdleTimeout() time.Duration {
+	return time.Duration(sc.IdleTimeoutSeconds) * time.Second
+}
+
+// KeyCacheTTL returns the time the authorized key lookups are cached.
+func (sc *ServerConfig) KeyCacheTTL() time.Duration {
+	return time.Duration(sc.KeyCacheTTLSeconds) * time.Second
+}
+
+// KeyCacheNegativeTTL returns the time the keys that aren't found are cached.
+func (sc *ServerConfig) KeyCacheNegativeTTL() time.Duration {
+	return time.Duration(sc.KeyCacheNegativeTTLSeconds) * time.Second
+}
+
+// AcceptsEnv reports whether an environment variable sent by a client matches
+// one of the accept_env patterns.
+func (sc *ServerConfig) AcceptsEnv(name string) bool {
+	for _, pattern := range sc.AcceptEnv {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ListenerConfigs returns the listeners of the server. Without a listeners
+// section, the server has a single listener using the top-level listen, PROXY
+// protocol and connection limit settings.
+func (sc *ServerConfig) ListenerConfigs() []ListenerConfig {
+	if len(sc.Listeners) == 0 {
+		return []ListenerConfig{{
+			Name:                   defaultListenerName,
+			Network:                defaultListenerNetwork,
+			Listen:                 sc.Listen,
+			ProxyProtocol:          sc.ProxyProtocol,
+			ProxyPolicy:            sc.ProxyPolicy,
+			ProxyAllowed:           sc.ProxyAllowed,
+			ConnectionLimitsConfig: sc.ConnectionLimitsConfig,
+		}}
+	}
+
+	listeners := make([]ListenerConfig, len(sc.Listeners))
+	for i, listener := range sc.Listeners {
+		if listener.Network == "" {
+			listener.Network = defaultListenerNetwork
+		}
+		if listener.AuthFailureBanSeconds == 0 {
+			listener.AuthFailureBanSeconds = DefaultServerConfig.AuthFailureBanSeconds
+		}
+		listeners[i] = listener
+	}
+
+	return listeners
+}
+
+func (sc *ServerConfig) checkListeners() error {
+	names := make(map[string]bool)
+	for _, listener := range sc.Listeners {
+		if listener.Name == "" {
+			return errors.New("sshd.listeners: name is required")
+		}
+		if listener.Name == MonitoringListenerName {
+			return fmt.Errorf("sshd.listeners: the name %q is reserved", listener.Name)
+		}
+		if names[listener.Name] {
+			return fmt.Errorf("sshd.listeners: duplicate name %q", listener.Name)
+		}
+		names[listener.Name] = true
+
+		if listener.Listen == "" {
+			return fmt.Errorf("sshd.listeners.%v: listen is required", listener.Name)
+		}
+		switch listener.Network {
+		case "", "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return fmt.Errorf("sshd.listeners.%v: unsupported network %q", listener.Name, listener.Network)
+		}
+		if err := listener.checkProxy("sshd.listeners." + listener.Name); err != nil {
+			return err
+		}
+	}
+
+	if len(sc.Listeners) == 0 {
+		return sc.ListenerConfigs()[0].checkProxy("sshd")
+	}
+
+	return nil
+}
+
+// checkProxy checks the PROXY protocol settings of a listener, found in the
+// prefix section of the configuration.
+func (lc ListenerConfig) checkProxy(prefix string) error {
+	switch strings.ToLower(lc.ProxyPolicy) {
+	case "", "use", "require", "ignore", "reject":
+	default:
+		return fmt.Errorf("%v.proxy_policy: unsupported value %q", prefix, lc.ProxyPolicy)
+	}
+
+	for _, allowed := range lc.ProxyAllowed {
+		if strings.Contains(allowed, "/") {
+			if _, _, err := net.ParseCIDR(allowed); err != nil {
+				return fmt.Errorf("%v.proxy_allowed: invalid CIDR range %q", prefix, allowed)
+			}
+		} else if net.ParseIP(allowed) == nil {
+			return fmt.Errorf("%v.proxy_allowed: invalid IP address %q", prefix, allowed)
+		}
+	}
+
+	// The peers of a Unix socket have no IP address to check
+	if lc.Network == "unix" && len(lc.ProxyAllowed) > 0 {
+		return fmt.Errorf("%v: proxy_allowed can't be used with the unix network", prefix)
+	}
+
+	return nil
+}
+
+// SSHUser returns the configuration of an SSH login name, and whether the name
+// is accepted. Without a users section, only the GitLab user is accepted.
+func (c *Config) SSHUser(name string) (SSHUserConfig, bool) {
+	if len(c.Server.Users) == 0 {
+		return SSHUserConfig{Name: c.User, Access: SSHUserAccessAll}, name == c.User
+	}
+
+	for _, user := range c.Server.Users {
+		if user.Name != name {
+			continue
+		}
+		if user.Access == "" {
+			user.Access = SSHUserAccessAll
+		}
+
+		return user, true
+	}
+
+	return SSHUserConfig{}, false
+}
+
+func (sc *ServerConfig) checkUsers() error {
+	names := make(map[string]bool)
+	for _, user := range sc.Users {
+		if user.Name == "" {
+			return errors.New("sshd.users: name is required")
+		}
+		if names[user.Name] {
+			return fmt.Errorf("sshd.users: duplicate name %q", user.Name)
+		}
+		names[user.Name] = true
+
+		switch user.Access {
+		case "", SSHUserAccessAll, SSHUserAccessDeployKeys:
+		default:
+			return fmt.Errorf("sshd.users.%v: unsupported access %q", user.Name, user.Access)
+		}
+	}
+
+	return nil
+}
+
+// AuthFailureBanDuration returns how long a source is banned after too many
+// failed authentication attempts. Failures are counted over the same period.
+func (lc *ConnectionLimitsConfig) AuthFailureBanDuration() time.Duration {
+	return time.Duration(lc.AuthFailureBanSeconds) * time.Second
+}
+
+// GetHttpClient returns the HTTP client of the internal API. It's created
+// once, so that all the requests share its pool of connections.
 func (c *Config) GetHttpClient() *client.HttpClient {
+	httpClientMu.Lock()
+	defer httpClientMu.Unlock()
+
 	if c.HttpClient != nil {
 		return c.HttpClient
 	}
 
-	client := client.NewHTTPClient(
+	httpClient, err := client.NewHTTPClientWithOpts(
 		c.GitlabUrl,
 		c.GitlabRelativeURLRoot,
 		c.HttpSettings.CaFile,
 		c.HttpSettings.CaPath,
 		c.HttpSettings.SelfSignedCert,
-		c.HttpSettings.ReadTimeoutSeconds)
+		c.HttpSettings.ReadTimeoutSeconds,
+		c.HttpSettings.httpClientOpts(),
+	)
+	if err != nil {
+		log.WithError(err).Error("new http client with opts")
+		return nil
+	}
+
+	c.HttpClient = httpClient
+
+	return httpClient
+}
+
+func (hs *HttpSettingsConfig) httpClientOpts() []client.HTTPClientOpt {
+	opts := []client.HTTPClientOpt{
+		client.WithIdleConnections(
+			hs.MaxIdleConns,
+			hs.MaxIdleConnsPerHost,
+			time.Duration(hs.IdleConnTimeoutSeconds)*time.Second,
+		),
+		client.WithTimeouts(
+			time.Duration(hs.DialTimeoutSeconds)*time.Second,
+			time.Duration(hs.TLSHandshakeTimeoutSeconds)*time.Second,
+			time.Duration(hs.ResponseHeaderTimeoutSeconds)*time.Second,
+		),
+	}
+
+	if hs.ClientCert != "" && hs.ClientKey != "" {
+		opts = append(opts, client.WithClientCert(hs.ClientCert, hs.ClientKey))
+	}
+
+	return opts
+}
 
-	c.HttpClient = client
+func (hs *HttpSettingsConfig) checkClientCert() error {
+	switch {
+	case hs.ClientCert == "" && hs.ClientKey == "":
+		return nil
+	case hs.ClientCert == "":
+		return errors.New("http_settings.client_cert is required when http_settings.client_key is set")
+	case hs.ClientKey == "":
+		return errors.New("http_settings.client_key is required when http_settings.client_cert is set")
+	}
+
+	if _, err := tls.LoadX509KeyPair(hs.ClientCert, hs.ClientKey); err != nil {
+		return fmt.Errorf("http_settings.client_cert: failed to load the client certificate: %w", err)
+	}
+
+	return nil
+}
+
+// RetryPolicy returns how the requests to the internal API are retried.
+func (hs *HttpSettingsConfig) RetryPolicy() client.RetryPolicy {
+	return client.RetryPolicy{
+		Retries:    hs.Retries,
+		MinBackoff: time.Duration(hs.RetryMinBackoffMilliseconds) * time.Millisecond,
+		MaxBackoff: time.Duration(hs.RetryMaxBackoffMilliseconds) * time.Millisecond,
+	}
+}
+
+// EndpointTimeouts returns the time allowed for the requests to the endpoints
+// of the internal API that have their own timeout, retries included, by path
+// relative to /api/v4/internal. Setting the timeout of an endpoint to 0 removes it.
+func (hs *HttpSettingsConfig) EndpointTimeouts() map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for endpoint, timeout := range defaultEndpointTimeouts {
+		timeouts[endpoint] = timeout
+	}
 
-	return client
+	for endpoint, seconds := range hs.EndpointTimeoutsSeconds {
+		endpoint = "/" + strings.Trim(strings.TrimPrefix(endpoint, "/api/v4/internal"), "/")
+		if seconds == 0 {
+			delete(timeouts, endpoint)
+			continue
+		}
+		timeouts[endpoint] = time.Duration(seconds) * time.Second
+	}
+
+	return timeouts
+}
+
+// SecretAuth returns how the requests to the internal API are authenticated
+// with the secret. Only the secret header is sent by default, as the JWT is
+// ignored by the GitLab versions that don't verify it.
+func (hs *HttpSettingsConfig) SecretAuth() client.SecretAuth {
+	switch hs.JWTAuth {
+	case JWTAuthEnabled:
+		return client.SecretHeaderAndJWT
+	case JWTAuthOnly:
+		return client.JWTOnly
+	default:
+		return client.SecretHeader
+	}
+}
+
+// GetCircuitBreaker returns the circuit breaker shared by the clients of the
+// internal API, or nil when it's disabled.
+func (c *Config) GetCircuitBreaker() *client.CircuitBreaker {
+	httpClientMu.Lock()
+	defer httpClientMu.Unlock()
+
+	if c.circuitBreaker == nil {
+		c.circuitBreaker = client.NewCircuitBreaker(
+			c.HttpSettings.CircuitBreakerThreshold,
+			time.Duration(c.HttpSettings.CircuitBreakerCooldownSeconds)*time.Second,
+		)
+	}
+
+	return c.circuitBreaker
 }
 
 // NewFromDirExternal returns a new config from a given root dir. It also applies defaults appropriate for
@@ -175,5 +604,30 @@ func (cfg *Config) IsSane() error {
 	if cfg.Secret == "" {
 		return errors.New("secret or secret_file_path is required")
 	}
+	if cfg.Server.TrustedUserCAKeys != "" && len(cfg.Server.AuthorizedPrincipals) == 0 {
+		return errors.New("sshd.authorized_principals is required when sshd.trusted_user_ca_keys is set")
+	}
+	if err := cfg.HttpSettings.checkClientCert(); err != nil {
+		return err
+	}
+	switch cfg.HttpSettings.JWTAuth {
+	case "", JWTAuthDisabled, JWTAuthEnabled, JWTAuthOnly:
+	default:
+		return fmt.Errorf("http_settings.jwt_auth: unsupported value %q", cfg.HttpSettings.JWTAuth)
+	}
+	if err := cfg.Server.checkAlgorithms(); err != nil {
+		return err
+	}
+	if err := cfg.Server.checkListeners(); err != nil {
+		return err
+	}
+	if err := cfg.Server.checkUsers(); err != nil {
+		return err
+	}
+	for _, pattern := range cfg.Server.AcceptEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("sshd.accept_env: invalid pattern %q", pattern)
+		}
+	}
 	return nil
 }
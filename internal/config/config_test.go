@@ -0,0 +1,457 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/client"
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/testhelper"
+)
+
+func TestIsSaneAlgorithms(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		server        ServerConfig
+		expectedError string
+	}{
+		{
+			desc: "defaults",
+		},
+		{
+			desc: "supported algorithms",
+			server: ServerConfig{
+				Ciphers:             []string{"aes256-ctr", "chacha20-poly1305@openssh.com"},
+				KexAlgorithms:       []string{"curve25519-sha256@libssh.org"},
+				MACs:                []string{"hmac-sha2-256-etm@openssh.com"},
+				PublicKeyAlgorithms: []string{"ssh-ed25519", "ssh-rsa"},
+				MinRSAKeySize:       2048,
+			},
+		},
+		{
+			desc:          "unsupported cipher",
+			server:        ServerConfig{Ciphers: []string{"arcfour"}},
+			expectedError: `sshd.ciphers: unsupported algorithm "arcfour"`,
+		},
+		{
+			desc:          "unsupported key exchange",
+			server:        ServerConfig{KexAlgorithms: []string{"diffie-hellman-group1-sha1"}},
+			expectedError: `sshd.kex_algorithms: unsupported algorithm "diffie-hellman-group1-sha1"`,
+		},
+		{
+			desc:          "unsupported MAC",
+			server:        ServerConfig{MACs: []string{"hmac-md5"}},
+			expectedError: `sshd.macs: unsupported algorithm "hmac-md5"`,
+		},
+		{
+			desc:          "DSA public keys",
+			server:        ServerConfig{PublicKeyAlgorithms: []string{"ssh-dss"}},
+			expectedError: `sshd.public_key_algorithms: unsupported algorithm "ssh-dss"`,
+		},
+		{
+			desc:          "negative RSA key size",
+			server:        ServerConfig{MinRSAKeySize: -1},
+			expectedError: "sshd.min_rsa_key_size must not be negative",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := &Config{GitlabUrl: "http+unix://gitlab.socket", Secret: "secret", Server: tc.server}
+
+			err := cfg.IsSane()
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestAcceptsEnv(t *testing.T) {
+	sc := &ServerConfig{AcceptEnv: []string{"GIT_TRACE_PACKET", "GL_*"}}
+
+	require.True(t, sc.AcceptsEnv("GIT_TRACE_PACKET"))
+	require.True(t, sc.AcceptsEnv("GL_OPTION"))
+	require.False(t, sc.AcceptsEnv("GIT_TRACE"))
+	require.False(t, sc.AcceptsEnv("LD_PRELOAD"))
+
+	require.False(t, (&ServerConfig{}).AcceptsEnv("GL_OPTION"))
+}
+
+func TestIsSaneAcceptEnv(t *testing.T) {
+	cfg := &Config{GitlabUrl: "http+unix://gitlab.socket", Secret: "secret"}
+	cfg.Server.AcceptEnv = []string{"GL_[*"}
+
+	require.EqualError(t, cfg.IsSane(), `sshd.accept_env: invalid pattern "GL_[*"`)
+}
+
+func TestListenerConfigs(t *testing.T) {
+	sc := DefaultServerConfig
+	sc.ProxyProtocol = true
+	sc.MaxConnections = 100
+
+	require.Equal(t, []ListenerConfig{
+		{
+			Name:                   "default",
+			Network:                "tcp",
+			Listen:                 "[::]:22",
+			ProxyProtocol:          true,
+			ConnectionLimitsConfig: ConnectionLimitsConfig{MaxConnections: 100, AuthFailureBanSeconds: 300},
+		},
+	}, sc.ListenerConfigs())
+
+	sc.Listeners = []ListenerConfig{
+		{Name: "public", Listen: "0.0.0.0:22"},
+		{Name: "sidecar", Network: "unix", Listen: "/run/gitlab-sshd.sock", ProxyProtocol: true},
+	}
+
+	require.Equal(t, []ListenerConfig{
+		{
+			Name:                   "public",
+			Network:                "tcp",
+			Listen:                 "0.0.0.0:22",
+			ConnectionLimitsConfig: ConnectionLimitsConfig{AuthFailureBanSeconds: 300},
+		},
+		{
+			Name:                   "sidecar",
+			Network:                "unix",
+			Listen:                 "/run/gitlab-sshd.sock",
+			ProxyProtocol:          true,
+			ConnectionLimitsConfig: ConnectionLimitsConfig{AuthFailureBanSeconds: 300},
+		},
+	}, sc.ListenerConfigs())
+}
+
+func TestIsSaneListeners(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		listeners     []ListenerConfig
+		expectedError string
+	}{
+		{
+			desc:      "valid listeners",
+			listeners: []ListenerConfig{{Name: "ipv4", Listen: "0.0.0.0:22"}, {Name: "sidecar", Network: "unix", Listen: "/run/gitlab-sshd.sock"}},
+		},
+		{
+			desc:          "missing name",
+			listeners:     []ListenerConfig{{Listen: "0.0.0.0:22"}},
+			expectedError: "sshd.listeners: name is required",
+		},
+		{
+			desc:          "duplicate name",
+			listeners:     []ListenerConfig{{Name: "ssh", Listen: "0.0.0.0:22"}, {Name: "ssh", Listen: "[::]:22"}},
+			expectedError: `sshd.listeners: duplicate name "ssh"`,
+		},
+		{
+			desc:          "reserved name",
+			listeners:     []ListenerConfig{{Name: "monitoring", Listen: "0.0.0.0:22"}},
+			expectedError: `sshd.listeners: the name "monitoring" is reserved`,
+		},
+		{
+			desc:          "missing address",
+			listeners:     []ListenerConfig{{Name: "ssh"}},
+			expectedError: "sshd.listeners.ssh: listen is required",
+		},
+		{
+			desc:          "unsupported network",
+			listeners:     []ListenerConfig{{Name: "ssh", Network: "udp", Listen: "0.0.0.0:22"}},
+			expectedError: `sshd.listeners.ssh: unsupported network "udp"`,
+		},
+		{
+			desc:      "valid PROXY protocol settings",
+			listeners: []ListenerConfig{{Name: "ssh", Listen: "0.0.0.0:22", ProxyProtocol: true, ProxyPolicy: "Require", ProxyAllowed: []string{"10.0.0.1", "2001:db8::/32"}}},
+		},
+		{
+			desc:          "unsupported PROXY policy",
+			listeners:     []ListenerConfig{{Name: "ssh", Listen: "0.0.0.0:22", ProxyPolicy: "trust-everyone"}},
+			expectedError: `sshd.listeners.ssh.proxy_policy: unsupported value "trust-everyone"`,
+		},
+		{
+			desc:          "invalid allowed PROXY source",
+			listeners:     []ListenerConfig{{Name: "ssh", Listen: "0.0.0.0:22", ProxyAllowed: []string{"10.0.0.0/33"}}},
+			expectedError: `sshd.listeners.ssh.proxy_allowed: invalid CIDR range "10.0.0.0/33"`,
+		},
+		{
+			desc:          "allowed PROXY sources on a unix socket",
+			listeners:     []ListenerConfig{{Name: "sidecar", Network: "unix", Listen: "/run/gitlab-sshd.sock", ProxyProtocol: true, ProxyAllowed: []string{"127.0.0.1"}}},
+			expectedError: "sshd.listeners.sidecar: proxy_allowed can't be used with the unix network",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := &Config{GitlabUrl: "http+unix://gitlab.socket", Secret: "secret"}
+			cfg.Server.Listeners = tc.listeners
+
+			err := cfg.IsSane()
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestIsSaneProxy(t *testing.T) {
+	cfg := &Config{GitlabUrl: "http+unix://gitlab.socket", Secret: "secret"}
+	cfg.Server.ProxyAllowed = []string{"not-an-ip"}
+	require.EqualError(t, cfg.IsSane(), `sshd.proxy_allowed: invalid IP address "not-an-ip"`)
+
+	cfg.Server.ProxyAllowed = nil
+	cfg.Server.ProxyPolicy = "trust-everyone"
+	require.EqualError(t, cfg.IsSane(), `sshd.proxy_policy: unsupported value "trust-everyone"`)
+}
+
+func TestSSHUser(t *testing.T) {
+	cfg := &Config{User: "git"}
+
+	user, ok := cfg.SSHUser("git")
+	require.True(t, ok)
+	require.Equal(t, SSHUserConfig{Name: "git", Access: SSHUserAccessAll}, user)
+
+	_, ok = cfg.SSHUser("deploy")
+	require.False(t, ok)
+
+	cfg.Server.Users = []SSHUserConfig{
+		{Name: "git"},
+		{Name: "deploy", Access: SSHUserAccessDeployKeys},
+		{Name: "mirror", Access: SSHUserAccessAll},
+	}
+
+	user, ok = cfg.SSHUser("git")
+	require.True(t, ok)
+	require.Equal(t, SSHUserConfig{Name: "git", Access: SSHUserAccessAll}, user)
+
+	user, ok = cfg.SSHUser("deploy")
+	require.True(t, ok)
+	require.Equal(t, SSHUserConfig{Name: "deploy", Access: SSHUserAccessDeployKeys}, user)
+
+	_, ok = cfg.SSHUser("root")
+	require.False(t, ok)
+}
+
+func TestIsSaneUsers(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		users         []SSHUserConfig
+		expectedError string
+	}{
+		{
+			desc:  "valid users",
+			users: []SSHUserConfig{{Name: "git"}, {Name: "deploy", Access: "deploy_keys"}},
+		},
+		{
+			desc:          "missing name",
+			users:         []SSHUserConfig{{Access: "all"}},
+			expectedError: "sshd.users: name is required",
+		},
+		{
+			desc:          "duplicate name",
+			users:         []SSHUserConfig{{Name: "git"}, {Name: "git", Access: "deploy_keys"}},
+			expectedError: `sshd.users: duplicate name "git"`,
+		},
+		{
+			desc:          "unsupported access",
+			users:         []SSHUserConfig{{Name: "git", Access: "admin"}},
+			expectedError: `sshd.users.git: unsupported access "admin"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := &Config{GitlabUrl: "http+unix://gitlab.socket", Secret: "secret"}
+			cfg.Server.Users = tc.users
+
+			err := cfg.IsSane()
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	settings := DefaultConfig.HttpSettings
+
+	require.Equal(t, client.RetryPolicy{
+		Retries:    2,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 2 * time.Second,
+	}, settings.RetryPolicy())
+}
+
+func TestGetCircuitBreaker(t *testing.T) {
+	cfg := &Config{}
+	require.Nil(t, cfg.GetCircuitBreaker())
+
+	cfg.HttpSettings.CircuitBreakerThreshold = 5
+	breaker := cfg.GetCircuitBreaker()
+	require.NotNil(t, breaker)
+	require.Same(t, breaker, cfg.GetCircuitBreaker())
+}
+
+func TestGetHttpClient(t *testing.T) {
+	cfg := &Config{
+		GitlabUrl: "http://localhost:3000",
+		HttpSettings: HttpSettingsConfig{
+			MaxIdleConns:           10,
+			MaxIdleConnsPerHost:    5,
+			IdleConnTimeoutSeconds: 30,
+		},
+	}
+
+	clients := make(chan *client.HttpClient, 10)
+	for i := 0; i < cap(clients); i++ {
+		go func() { clients <- cfg.GetHttpClient() }()
+	}
+
+	httpClient := <-clients
+	require.NotNil(t, httpClient)
+	for i := 1; i < cap(clients); i++ {
+		require.Same(t, httpClient, <-clients, "the client must be shared")
+	}
+
+	cfg = &Config{GitlabUrl: "ftp://localhost"}
+	require.Nil(t, cfg.GetHttpClient())
+}
+
+func TestSecretAuth(t *testing.T) {
+	testCases := []struct {
+		jwtAuth  string
+		expected client.SecretAuth
+	}{
+		{jwtAuth: "", expected: client.SecretHeader},
+		{jwtAuth: JWTAuthDisabled, expected: client.SecretHeader},
+		{jwtAuth: JWTAuthEnabled, expected: client.SecretHeaderAndJWT},
+		{jwtAuth: JWTAuthOnly, expected: client.JWTOnly},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.jwtAuth, func(t *testing.T) {
+			settings := HttpSettingsConfig{JWTAuth: tc.jwtAuth}
+			require.Equal(t, tc.expected, settings.SecretAuth())
+		})
+	}
+
+	cfg := &Config{GitlabUrl: "http+unix://gitlab.socket", Secret: "secret"}
+	cfg.HttpSettings.JWTAuth = "always"
+	require.EqualError(t, cfg.IsSane(), `http_settings.jwt_auth: unsupported value "always"`)
+}
+
+func TestIsSaneClientCert(t *testing.T) {
+	cleanup, err := testhelper.PrepareTestRootDir()
+	require.NoError(t, err)
+	defer cleanup()
+
+	certs := filepath.Join(testhelper.TestRoot, "certs")
+
+	testCases := []struct {
+		desc          string
+		cert, key     string
+		expectedError string
+	}{
+		{
+			desc: "no client certificate",
+		},
+		{
+			desc: "valid client certificate",
+			cert: filepath.Join(certs, "client", "server.crt"),
+			key:  filepath.Join(certs, "client", "key.pem"),
+		},
+		{
+			desc:          "missing key",
+			cert:          filepath.Join(certs, "client", "server.crt"),
+			expectedError: "http_settings.client_key is required when http_settings.client_cert is set",
+		},
+		{
+			desc:          "missing certificate",
+			key:           filepath.Join(certs, "client", "key.pem"),
+			expectedError: "http_settings.client_cert is required when http_settings.client_key is set",
+		},
+		{
+			desc:          "mismatched key",
+			cert:          filepath.Join(certs, "client", "server.crt"),
+			key:           filepath.Join(certs, "valid", "server.key"),
+			expectedError: "http_settings.client_cert: failed to load the client certificate: tls: private key does not match public key",
+		},
+		{
+			desc:          "missing file",
+			cert:          filepath.Join(certs, "client", "missing.crt"),
+			key:           filepath.Join(certs, "client", "key.pem"),
+			expectedError: "http_settings.client_cert: failed to load the client certificate: open " + filepath.Join(certs, "client", "missing.crt") + ": no such file or directory",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := &Config{GitlabUrl: "https://gitlab.example.com", Secret: "secret"}
+			cfg.HttpSettings.ClientCert = tc.cert
+			cfg.HttpSettings.ClientKey = tc.key
+
+			err := cfg.IsSane()
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestGetHttpClientWithClientCert(t *testing.T) {
+	cleanup, err := testhelper.PrepareTestRootDir()
+	require.NoError(t, err)
+	defer cleanup()
+
+	certs := filepath.Join(testhelper.TestRoot, "certs")
+	url := testserver.StartHttpsServer(t, []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/hello",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "Hello")
+			},
+		},
+	}, filepath.Join(certs, "client", "server.crt"))
+
+	cfg := &Config{GitlabUrl: url}
+	cfg.HttpSettings.CaFile = filepath.Join(certs, "valid", "server.crt")
+
+	_, err = cfg.GetHttpClient().Get(url + "/api/v4/internal/hello")
+	require.Error(t, err, "the server requires a client certificate")
+
+	cfg = &Config{GitlabUrl: url}
+	cfg.HttpSettings.CaFile = filepath.Join(certs, "valid", "server.crt")
+	cfg.HttpSettings.ClientCert = filepath.Join(certs, "client", "server.crt")
+	cfg.HttpSettings.ClientKey = filepath.Join(certs, "client", "key.pem")
+
+	response, err := cfg.GetHttpClient().Get(url + "/api/v4/internal/hello")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func TestEndpointTimeouts(t *testing.T) {
+	settings := HttpSettingsConfig{}
+	require.Equal(t, map[string]time.Duration{"/authorized_keys": 10 * time.Second}, settings.EndpointTimeouts())
+
+	settings.EndpointTimeoutsSeconds = map[string]uint64{
+		"authorized_keys":           0,
+		"/allowed":                  60,
+		"/api/v4/internal/discover": 5,
+	}
+	require.Equal(t, map[string]time.Duration{
+		"/allowed":  time.Minute,
+		"/discover": 5 * time.Second,
+	}, settings.EndpointTimeouts())
+}
@@ -22,13 +22,16 @@ type Client struct {
 }
 
 type Request struct {
-	Action   commandargs.CommandType `json:"action"`
-	Repo     string                  `json:"project"`
-	Changes  string                  `json:"changes"`
-	Protocol string                  `json:"protocol"`
-	KeyId    string                  `json:"key_id,omitempty"`
-	Username string                  `json:"username,omitempty"`
-	CheckIp  string                  `json:"check_ip,omitempty"`
+	Action        commandargs.CommandType `json:"action"`
+	Repo          string                  `json:"project"`
+	Changes       string                  `json:"changes"`
+	Protocol      string                  `json:"protocol"`
+	KeyId         string                  `json:"key_id,omitempty"`
+	Username      string                  `json:"username,omitempty"`
+	CheckIp       string                  `json:"check_ip,omitempty"`
+	SSHEnv        map[string]string       `json:"ssh_env,omitempty"`
+	SSHUser       string                  `json:"ssh_user,omitempty"`
+	SSHUserAccess string                  `json:"ssh_user_access,omitempty"`
 }
 
 type Gitaly struct {
@@ -87,6 +90,9 @@ func (c *Client) Verify(ctx context.Context, args *commandargs.Shell, action com
 	}
 
 	request.CheckIp = args.Env.RemoteAddr
+	request.SSHEnv = args.Env.Variables
+	request.SSHUser = args.SSHUser
+	request.SSHUserAccess = args.SSHUserAccess
 
 	response, err := c.client.Post(ctx, "/allowed", request)
 	if err != nil {
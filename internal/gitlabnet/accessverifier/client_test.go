@@ -14,6 +14,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/sshenv"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/testhelper"
 )
 
@@ -68,6 +69,14 @@ func TestSuccessfulResponses(t *testing.T) {
 			desc: "Provide username within the request",
 			args: &commandargs.Shell{GitlabUsername: "first"},
 			who:  "user-1",
+		}, {
+			desc: "Provide the accepted SSH environment variables within the request",
+			args: &commandargs.Shell{GitlabKeyId: "5", Env: sshenv.Env{Variables: map[string]string{"GL_OPTION": "value"}}},
+			who:  "key-5",
+		}, {
+			desc: "Provide the SSH user within the request",
+			args: &commandargs.Shell{GitlabKeyId: "6", SSHUser: "deploy", SSHUserAccess: "deploy_keys"},
+			who:  "key-6",
 		},
 	}
 
@@ -218,6 +227,15 @@ func setup(t *testing.T, allowedPayload string) *Client {
 					w.Write([]byte("{ \"message\": \"broken json!\""))
 				case "4":
 					w.WriteHeader(http.StatusForbidden)
+				case "5":
+					require.Equal(t, map[string]string{"GL_OPTION": "value"}, requestBody.SSHEnv)
+					_, err = w.Write(body)
+					require.NoError(t, err)
+				case "6":
+					require.Equal(t, "deploy", requestBody.SSHUser)
+					require.Equal(t, "deploy_keys", requestBody.SSHUserAccess)
+					_, err = w.Write(body)
+					require.NoError(t, err)
 				}
 			},
 		},
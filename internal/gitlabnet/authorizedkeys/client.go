@@ -1,19 +1,33 @@
 package authorizedkeys
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
 
 	"gitlab.com/gitlab-org/gitlab-shell/client"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/gitlabnet"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/keyline"
 )
 
 const (
 	AuthorizedKeysPath = "/authorized_keys"
+
+	// The longest line read from the authorized keys file.
+	maxKeyLineSize = 64 * 1024
 )
 
+var errKeyNotInFile = errors.New("key not found in the authorized keys file")
+
 type Client struct {
 	config *config.Config
 	client *client.GitlabNetClient
@@ -22,6 +36,9 @@ type Client struct {
 type Response struct {
 	Id  int64  `json:"id"`
 	Key string `json:"key"`
+	// FromAuthFile is set when the key was found in the auth_file because the
+	// internal API was unavailable.
+	FromAuthFile bool `json:"-"`
 }
 
 func NewClient(config *config.Config) (*Client, error) {
@@ -33,7 +50,29 @@ func NewClient(config *config.Config) (*Client, error) {
 	return &Client{config: config, client: client}, nil
 }
 
+// GetByKey looks up a key, given as the base64 encoding of its wire format.
+// When the internal API is unreachable and the auth_file fallback is enabled,
+// the key is looked up in that file instead.
 func (c *Client) GetByKey(ctx context.Context, key string) (*Response, error) {
+	response, err := c.getByKeyFromAPI(ctx, key)
+	if err == nil || !c.config.AuthFileFallback || c.config.AuthFile == "" || !client.IsUnavailable(err) {
+		return response, err
+	}
+
+	logger := log.WithError(err).WithField("auth_file", c.config.AuthFile)
+
+	response, fileErr := c.getByKeyFromFile(key)
+	if fileErr != nil {
+		logger.WithField("auth_file_error", fileErr.Error()).Warn("Internal API unavailable and the key could not be found in the authorized keys file")
+		return nil, err
+	}
+
+	logger.WithField("key_id", response.Id).Warn("Internal API unavailable, using the key found in the authorized keys file")
+
+	return response, nil
+}
+
+func (c *Client) getByKeyFromAPI(ctx context.Context, key string) (*Response, error) {
 	path, err := pathWithKey(key)
 	if err != nil {
 		return nil, err
@@ -53,6 +92,59 @@ func (c *Client) GetByKey(ctx context.Context, key string) (*Response, error) {
 	return parsedResponse, nil
 }
 
+// getByKeyFromFile looks up a key in the authorized keys file written by
+// GitLab, in the format of keyline.KeyLine.
+func (c *Client) getByKeyFromFile(key string) (*Response, error) {
+	f, err := os.Open(c.config.AuthFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// gitlab-sshd doesn't pad the encoding of the key, unlike OpenSSH.
+	key = strings.TrimRight(key, "=")
+	keyBytes := []byte(key)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxKeyLineSize)
+
+	for scanner.Scan() {
+		// Only the lines containing the encoded key are parsed.
+		if !bytes.Contains(scanner.Bytes(), keyBytes) {
+			continue
+		}
+
+		keyLine, err := keyline.Parse(scanner.Text(), c.config)
+		if err != nil || keyLine.Prefix != keyline.PublicKeyPrefix || keyBlob(keyLine.Value) != key {
+			continue
+		}
+
+		id, err := strconv.ParseInt(keyLine.Id, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		return &Response{Id: id, Key: keyLine.Value, FromAuthFile: true}, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, errKeyNotInFile
+}
+
+// keyBlob returns the unpadded base64 encoding of the key of an authorized key
+// value, made of the key type, the encoded key and an optional comment.
+func keyBlob(value string) string {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return ""
+	}
+
+	return strings.TrimRight(fields[1], "=")
+}
+
 func pathWithKey(key string) (string, error) {
 	u, err := url.Parse(AuthorizedKeysPath)
 	if err != nil {
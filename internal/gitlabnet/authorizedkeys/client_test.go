@@ -2,14 +2,23 @@ package authorizedkeys
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
 	"gitlab.com/gitlab-org/gitlab-shell/client"
 	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/keyline"
 )
 
 var (
@@ -37,6 +46,8 @@ func init() {
 					w.Write([]byte("{ \"message\": \"broken json!\""))
 				} else if r.URL.Query().Get("key") == "broken-empty" {
 					w.WriteHeader(http.StatusForbidden)
+				} else if strings.HasPrefix(r.URL.Query().Get("key"), "AAAA") {
+					w.WriteHeader(http.StatusServiceUnavailable)
 				} else {
 					w.WriteHeader(http.StatusNotFound)
 				}
@@ -93,6 +104,90 @@ func TestGetByKeyErrorResponses(t *testing.T) {
 	}
 }
 
+func TestGetByKeyFromAuthFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorized-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{RootDir: "/tmp", AuthFile: filepath.Join(dir, "authorized_keys"), AuthFileFallback: true}
+
+	knownKey := generateKey(t)
+	otherKey := generateKey(t)
+	unknownKey := generateKey(t)
+
+	lines := []string{"# Managed by gitlab-rails"}
+	for id, key := range map[string]ssh.PublicKey{"1": otherKey, "42": knownKey} {
+		keyLine, err := keyline.NewPublicKeyLine(id, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), cfg)
+		require.NoError(t, err)
+		lines = append(lines, keyLine.ToString())
+	}
+	require.NoError(t, ioutil.WriteFile(cfg.AuthFile, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+
+	expected := &Response{Id: 42, Key: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(knownKey))), FromAuthFile: true}
+
+	t.Run("API unavailable", func(t *testing.T) {
+		cfg.GitlabUrl = testserver.StartSocketHttpServer(t, requests)
+		client, err := NewClient(cfg)
+		require.NoError(t, err)
+
+		result, err := client.GetByKey(context.Background(), base64.RawStdEncoding.EncodeToString(knownKey.Marshal()))
+		require.NoError(t, err)
+		require.Equal(t, expected, result)
+
+		_, err = client.GetByKey(context.Background(), base64.RawStdEncoding.EncodeToString(unknownKey.Marshal()))
+		require.EqualError(t, err, "Internal API error (503)")
+
+		_, err = client.GetByKey(context.Background(), "not-found")
+		require.EqualError(t, err, "Internal API error (404)", "keys unknown to the API aren't looked up in the file")
+	})
+
+	t.Run("API unreachable", func(t *testing.T) {
+		cfg.GitlabUrl = "http+unix://" + filepath.Join(dir, "missing.socket")
+		cfg.HttpClient = nil
+		client, err := NewClient(cfg)
+		require.NoError(t, err)
+
+		result, err := client.GetByKey(context.Background(), base64.StdEncoding.EncodeToString(knownKey.Marshal()))
+		require.NoError(t, err)
+		require.Equal(t, expected, result)
+	})
+
+	t.Run("fallback disabled", func(t *testing.T) {
+		cfg.GitlabUrl = "http+unix://" + filepath.Join(dir, "missing.socket")
+		cfg.AuthFileFallback = false
+		cfg.HttpClient = nil
+		defer func() { cfg.AuthFileFallback = true }()
+		client, err := NewClient(cfg)
+		require.NoError(t, err)
+
+		_, err = client.GetByKey(context.Background(), base64.StdEncoding.EncodeToString(knownKey.Marshal()))
+		require.EqualError(t, err, "Internal API unreachable")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		cfg.GitlabUrl = "http+unix://" + filepath.Join(dir, "missing.socket")
+		cfg.AuthFile = filepath.Join(dir, "missing")
+		cfg.HttpClient = nil
+		client, err := NewClient(cfg)
+		require.NoError(t, err)
+
+		_, err = client.GetByKey(context.Background(), base64.StdEncoding.EncodeToString(knownKey.Marshal()))
+		require.EqualError(t, err, "Internal API unreachable")
+	})
+}
+
+func generateKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	key, err := ssh.NewPublicKey(publicKey)
+	require.NoError(t, err)
+
+	return key
+}
+
 func setup(t *testing.T) *Client {
 	url := testserver.StartSocketHttpServer(t, requests)
 
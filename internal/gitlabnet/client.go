@@ -21,7 +21,17 @@ func GetClient(config *config.Config) (*client.GitlabNetClient, error) {
 		return nil, fmt.Errorf("Unsupported protocol")
 	}
 
-	return client.NewGitlabNetClient(config.HttpSettings.User, config.HttpSettings.Password, config.Secret, httpClient)
+	gitlabNetClient, err := client.NewGitlabNetClient(config.HttpSettings.User, config.HttpSettings.Password, config.Secret, httpClient)
+	if err != nil {
+		return nil, err
+	}
+
+	gitlabNetClient.SetEndpointTimeouts(config.HttpSettings.EndpointTimeouts())
+	gitlabNetClient.SetSecretAuth(config.HttpSettings.SecretAuth())
+	gitlabNetClient.SetRetryPolicy(config.HttpSettings.RetryPolicy())
+	gitlabNetClient.SetCircuitBreaker(config.GetCircuitBreaker())
+
+	return gitlabNetClient, nil
 }
 
 func ParseJSON(hr *http.Response, response interface{}) error {
@@ -38,6 +38,28 @@ func TestCheck(t *testing.T) {
 	require.Equal(t, testResponse, result)
 }
 
+func TestCheckWithJWT(t *testing.T) {
+	secret := "sssh, it's a secret"
+	url := testserver.StartSocketHttpServer(t, []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/check",
+			Handler: testserver.RequireJWT(secret, func(w http.ResponseWriter, r *http.Request) {
+				require.Empty(t, r.Header.Get("Gitlab-Shared-Secret"))
+				json.NewEncoder(w).Encode(testResponse)
+			}),
+		},
+	})
+
+	cfg := &config.Config{GitlabUrl: url, Secret: secret}
+	cfg.HttpSettings.JWTAuth = config.JWTAuthOnly
+	client, err := NewClient(cfg)
+	require.NoError(t, err)
+
+	result, err := client.Check(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, testResponse, result)
+}
+
 func setup(t *testing.T) *Client {
 	url := testserver.StartSocketHttpServer(t, requests)
 
@@ -23,11 +23,26 @@ import (
 	"google.golang.org/grpc/metadata"
 )
 
+// envMetadataPrefix is prepended to the names of the environment variables
+// forwarded to Gitaly.
+const envMetadataPrefix = "ssh_env_"
+
 // GitalyHandlerFunc implementations are responsible for making
 // an appropriate Gitaly call using the provided client and context
 // and returning an error from the Gitaly call.
 type GitalyHandlerFunc func(ctx context.Context, client *grpc.ClientConn) (int32, error)
 
+// ExitError is returned when the git process run by Gitaly exits with a
+// non-zero status. Git has already reported the error to the client, so only
+// the status has to be passed on.
+type ExitError struct {
+	Code int32
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("git exited with status %d", e.Code)
+}
+
 type GitalyConn struct {
 	ctx   context.Context
 	conn  *grpc.ClientConn
@@ -52,11 +67,18 @@ func (gc *GitalyCommand) RunGitalyCommand(handler GitalyHandlerFunc) error {
 		return err
 	}
 
-	_, err = handler(gitalyConn.ctx, gitalyConn.conn)
+	exitCode, err := handler(gitalyConn.ctx, gitalyConn.conn)
 
 	gitalyConn.close()
 
-	return err
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return &ExitError{Code: exitCode}
+	}
+
+	return nil
 }
 
 // PrepareContext wraps a given context with a correlation ID and logs the command to
@@ -79,6 +101,9 @@ func (gc *GitalyCommand) PrepareContext(ctx context.Context, repository *pb.Repo
 	md.Append("user_id", response.UserId)
 	md.Append("username", response.Username)
 	md.Append("remote_ip", env.RemoteAddr)
+	for name, value := range env.Variables {
+		md.Append(envMetadataPrefix+name, value)
+	}
 	ctx = metadata.NewOutgoingContext(ctx, md)
 
 	return ctx, cancel
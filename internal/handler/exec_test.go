@@ -16,11 +16,15 @@ import (
 )
 
 func makeHandler(t *testing.T, err error) func(context.Context, *grpc.ClientConn) (int32, error) {
+	return makeHandlerWithExitCode(t, 0, err)
+}
+
+func makeHandlerWithExitCode(t *testing.T, exitCode int32, err error) func(context.Context, *grpc.ClientConn) (int32, error) {
 	return func(ctx context.Context, client *grpc.ClientConn) (int32, error) {
 		require.NotNil(t, ctx)
 		require.NotNil(t, client)
 
-		return 0, err
+		return exitCode, err
 	}
 }
 
@@ -36,6 +40,13 @@ func TestRunGitalyCommand(t *testing.T) {
 	expectedErr := errors.New("error")
 	err = cmd.RunGitalyCommand(makeHandler(t, expectedErr))
 	require.Equal(t, err, expectedErr)
+
+	err = cmd.RunGitalyCommand(makeHandlerWithExitCode(t, 128, nil))
+	require.Equal(t, &ExitError{Code: 128}, err)
+
+	// Errors take precedence over the exit code
+	err = cmd.RunGitalyCommand(makeHandlerWithExitCode(t, 1, expectedErr))
+	require.Equal(t, err, expectedErr)
 }
 
 func TestMissingGitalyAddress(t *testing.T) {
@@ -129,6 +140,38 @@ func TestPrepareContext(t *testing.T) {
 				"remote_ip": "10.0.0.1",
 			},
 		},
+		{
+			name: "ssh_environment",
+			gc: &GitalyCommand{
+				Config:  &config.Config{},
+				Address: "tcp://localhost:9999",
+			},
+			env: sshenv.Env{
+				IsSSHConnection: true,
+				RemoteAddr:      "10.0.0.1",
+				Variables:       map[string]string{"GIT_TRACE_PACKET": "1", "GL_OPTION": "value"},
+			},
+			repo: &pb.Repository{
+				StorageName:  "default",
+				RelativePath: "@hashed/5f/9c/5f9c4ab08cac7457e9111a30e4664920607ea2c115a1433d7be98e97e64244ca.git",
+				GlRepository: "project-26",
+			},
+			response: &accessverifier.Response{
+				KeyId:    1,
+				KeyType:  "key",
+				UserId:   "6",
+				Username: "jane.doe",
+			},
+			want: map[string]string{
+				"key_id":                   "1",
+				"key_type":                 "key",
+				"user_id":                  "6",
+				"username":                 "jane.doe",
+				"remote_ip":                "10.0.0.1",
+				"ssh_env_git_trace_packet": "1",
+				"ssh_env_gl_option":        "value",
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
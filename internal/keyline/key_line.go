@@ -12,7 +12,8 @@ import (
 )
 
 var (
-	keyRegex = regexp.MustCompile(`\A[a-z0-9-]+\z`)
+	keyRegex     = regexp.MustCompile(`\A[a-z0-9-]+\z`)
+	commandRegex = regexp.MustCompile(`\Acommand="[^"]* (key|username)-([^" ]+)"`)
 )
 
 const (
@@ -42,6 +43,31 @@ func (k *KeyLine) ToString() string {
 	return fmt.Sprintf(`command="%s",%s %s`, command, SshOptions, k.Value)
 }
 
+// Parse reads back a line of an authorized_keys file written in the format of
+// ToString. Comments and lines written by something else are rejected.
+func Parse(line string, config *config.Config) (*KeyLine, error) {
+	line = strings.TrimSpace(line)
+
+	// The options end at the first space that isn't quoted.
+	inQuotes := false
+	end := strings.IndexFunc(line, func(r rune) bool {
+		if r == '"' {
+			inQuotes = !inQuotes
+		}
+		return r == ' ' && !inQuotes
+	})
+	if end < 0 {
+		return nil, errors.New("Invalid key line: no options")
+	}
+
+	match := commandRegex.FindStringSubmatch(line[:end])
+	if match == nil {
+		return nil, errors.New("Invalid key line: no gitlab-shell command")
+	}
+
+	return newKeyLine(match[2], strings.TrimSpace(line[end:]), match[1], config)
+}
+
 func newKeyLine(id, value, prefix string, config *config.Config) (*KeyLine, error) {
 	if err := validate(id, value); err != nil {
 		return nil, err
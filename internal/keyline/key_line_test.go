@@ -80,3 +80,59 @@ func TestToString(t *testing.T) {
 	result := keyLine.ToString()
 	require.Equal(t, `command="/tmp/bin/gitlab-shell key-1",no-port-forwarding,no-X11-forwarding,no-agent-forwarding,no-pty public-key`, result)
 }
+
+func TestParse(t *testing.T) {
+	cfg := &config.Config{RootDir: "/tmp"}
+
+	keyLine, err := NewPublicKeyLine("1", "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDq user@host", cfg)
+	require.NoError(t, err)
+
+	result, err := Parse(keyLine.ToString(), cfg)
+	require.NoError(t, err)
+	require.Equal(t, keyLine, result)
+
+	principalLine, err := NewPrincipalKeyLine("alex-doe", "principal", cfg)
+	require.NoError(t, err)
+
+	result, err = Parse(principalLine.ToString()+"\n", cfg)
+	require.NoError(t, err)
+	require.Equal(t, principalLine, result)
+}
+
+func TestFailingParse(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		line          string
+		expectedError string
+	}{
+		{
+			desc:          "When the line is a comment",
+			line:          "# Managed by gitlab-rails",
+			expectedError: "Invalid key line: no gitlab-shell command",
+		},
+		{
+			desc:          "When the line has no options",
+			line:          "ssh-ed25519",
+			expectedError: "Invalid key line: no options",
+		},
+		{
+			desc:          "When the command isn't gitlab-shell's",
+			line:          `command="/bin/sh",no-pty ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDq`,
+			expectedError: "Invalid key line: no gitlab-shell command",
+		},
+		{
+			desc:          "When the id is invalid",
+			line:          `command="/tmp/bin/gitlab-shell key-1_2",no-pty ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDq`,
+			expectedError: "Invalid key_id: 1_2",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result, err := Parse(tc.line, &config.Config{RootDir: "/tmp"})
+
+			require.Nil(t, result)
+			require.EqualError(t, err, tc.expectedError)
+		})
+	}
+}
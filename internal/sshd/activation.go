@@ -0,0 +1,181 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+const (
+	// The first file descriptor passed by systemd or by the process that
+	// started this one during an upgrade.
+	listenFDsStart = 3
+
+	// The environment variables of systemd socket activation, see
+	// sd_listen_fds(3) and sd_notify(3).
+	listenPIDEnv     = "LISTEN_PID"
+	listenFDsEnv     = "LISTEN_FDS"
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+	notifySocketEnv  = "NOTIFY_SOCKET"
+
+	// The environment variables set for the new process during an upgrade.
+	upgradeFDNamesEnv = "GITLAB_SSHD_LISTEN_FDNAMES"
+	upgradeReadyFDEnv = "GITLAB_SSHD_READY_FD"
+)
+
+// inheritedFDNames returns the names of the listening sockets passed to this
+// process, either by systemd or by the process that started this one during
+// an upgrade. It returns nil when no sockets were passed.
+func inheritedFDNames(getenv func(string) string, pid int) ([]string, error) {
+	if names := getenv(upgradeFDNamesEnv); names != "" {
+		return strings.Split(names, ":"), nil
+	}
+
+	if getenv(listenFDsEnv) == "" || getenv(listenPIDEnv) != strconv.Itoa(pid) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(getenv(listenFDsEnv))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid %v: %q", listenFDsEnv, getenv(listenFDsEnv))
+	}
+
+	// Without names, the sockets can only be matched by address
+	names := make([]string, count)
+	if fdNames := getenv(listenFDNamesEnv); fdNames != "" {
+		copy(names, strings.Split(fdNames, ":"))
+	}
+
+	return names, nil
+}
+
+// inheritedListeners returns the listening sockets passed to this process.
+func inheritedListeners() ([]*inheritedListener, error) {
+	names, err := inheritedFDNames(os.Getenv, os.Getpid())
+	for _, env := range []string{listenPIDEnv, listenFDsEnv, listenFDNamesEnv, upgradeFDNamesEnv} {
+		os.Unsetenv(env)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, len(names))
+	for i, name := range names {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), name)
+	}
+
+	return listenersFromFiles(names, files)
+}
+
+type inheritedListener struct {
+	net.Listener
+	name string
+}
+
+func listenersFromFiles(names []string, files []*os.File) ([]*inheritedListener, error) {
+	var listeners []*inheritedListener
+	for i, file := range files {
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, fmt.Errorf("inherited socket %d is not a listener: %w", listenFDsStart+i, err)
+		}
+
+		listeners = append(listeners, &inheritedListener{Listener: l, name: names[i]})
+	}
+
+	return listeners, nil
+}
+
+// takeInheritedListener removes the socket of the given listener from the
+// inherited ones and returns it. The sockets are matched by name first, and
+// then by address.
+func takeInheritedListener(inherited []*inheritedListener, cfg config.ListenerConfig) (net.Listener, []*inheritedListener) {
+	match := func(l *inheritedListener) bool { return l.name != "" && l.name == cfg.Name }
+	if !hasInheritedListener(inherited, match) {
+		match = func(l *inheritedListener) bool {
+			return l.Addr().Network() == cfg.Network && l.Addr().String() == cfg.Listen
+		}
+	}
+
+	for i, l := range inherited {
+		if match(l) {
+			return l.Listener, append(inherited[:i:i], inherited[i+1:]...)
+		}
+	}
+
+	return nil, inherited
+}
+
+func hasInheritedListener(inherited []*inheritedListener, match func(*inheritedListener) bool) bool {
+	for _, l := range inherited {
+		if match(l) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notifyReady tells the process that started this one during an upgrade, and
+// systemd, that the server accepts connections.
+func notifyReady() {
+	if fd := os.Getenv(upgradeReadyFDEnv); fd != "" {
+		os.Unsetenv(upgradeReadyFDEnv)
+
+		if err := writeReadyFD(fd); err != nil {
+			log.WithError(err).Warn("Failed to notify the previous process")
+		}
+	}
+
+	if socket := os.Getenv(notifySocketEnv); socket != "" {
+		// MAINPID lets systemd follow the new process after an upgrade
+		state := fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())
+		if err := sdNotify(socket, state); err != nil {
+			log.WithError(err).Warn("Failed to notify systemd")
+		}
+	}
+}
+
+func writeReadyFD(fd string) error {
+	n, err := strconv.Atoi(fd)
+	if err != nil || n < listenFDsStart {
+		return fmt.Errorf("invalid %v: %q", upgradeReadyFDEnv, fd)
+	}
+
+	f := os.NewFile(uintptr(n), "ready")
+	defer f.Close()
+
+	_, err = f.Write([]byte{1})
+
+	return err
+}
+
+func sdNotify(socket, state string) error {
+	// An abstract socket
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return err
+	}
+
+	return nil
+}
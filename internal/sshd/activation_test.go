@@ -0,0 +1,128 @@
+package sshd
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+func TestInheritedFDNames(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		env           map[string]string
+		expected      []string
+		expectedError string
+	}{
+		{
+			desc: "no sockets",
+		},
+		{
+			desc:     "systemd with names",
+			env:      map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "public:sidecar"},
+			expected: []string{"public", "sidecar"},
+		},
+		{
+			desc:     "systemd without names",
+			env:      map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2"},
+			expected: []string{"", ""},
+		},
+		{
+			desc: "systemd sockets passed to another process",
+			env:  map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "2"},
+		},
+		{
+			desc:          "invalid systemd socket count",
+			env:           map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "two"},
+			expectedError: `invalid LISTEN_FDS: "two"`,
+		},
+		{
+			desc:     "upgrade",
+			env:      map[string]string{"GITLAB_SSHD_LISTEN_FDNAMES": "default:monitoring"},
+			expected: []string{"default", "monitoring"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			getenv := func(key string) string { return tc.env[key] }
+
+			names, err := inheritedFDNames(getenv, 42)
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, names)
+		})
+	}
+}
+
+func TestTakeInheritedListener(t *testing.T) {
+	named := inheritedTCPListener(t, "public")
+	unnamed := inheritedTCPListener(t, "")
+	inherited := []*inheritedListener{named, unnamed}
+
+	socket, inherited := takeInheritedListener(inherited, config.ListenerConfig{Name: "other", Network: "tcp", Listen: "[::]:22"})
+	require.Nil(t, socket)
+	require.Len(t, inherited, 2)
+
+	socket, inherited = takeInheritedListener(inherited, config.ListenerConfig{Name: "public", Network: "tcp", Listen: "[::]:22"})
+	require.Equal(t, named.Listener, socket)
+	require.Equal(t, []*inheritedListener{unnamed}, inherited)
+
+	socket, inherited = takeInheritedListener(inherited, config.ListenerConfig{Name: "internal", Network: "tcp", Listen: unnamed.Addr().String()})
+	require.Equal(t, unnamed.Listener, socket)
+	require.Empty(t, inherited)
+}
+
+func TestListenAndServeWithInheritedSocket(t *testing.T) {
+	inherited := inheritedTCPListener(t, "default")
+
+	cfg := buildConfig(t)
+	s := NewServer(cfg)
+	s.inheritOnce.Do(func() {
+		s.inherited = []*inheritedListener{inherited}
+	})
+
+	go s.ListenAndServe(context.Background())
+	t.Cleanup(func() { s.Shutdown() })
+
+	require.Eventually(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		return len(s.listeners) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, inherited.Addr(), s.listeners[0].Addr())
+
+	client, err := ssh.Dial("tcp", inherited.Addr().String(), clientConfig(t, s))
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+}
+
+// inheritedTCPListener returns a listener created from the file of a socket,
+// like the ones passed by systemd.
+func inheritedTCPListener(t *testing.T, name string) *inheritedListener {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+
+	listeners, err := listenersFromFiles([]string{name}, []*os.File{f})
+	require.NoError(t, err)
+	t.Cleanup(func() { listeners[0].Close() })
+
+	return listeners[0]
+}
@@ -0,0 +1,119 @@
+package sshd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+// certChecker authenticates OpenSSH user certificates signed by one of the
+// trusted CA keys. It follows the same rules as the OpenSSH flow with
+// gitlab-shell-authorized-principals-check: the certificate must be valid for
+// one of the authorized principals, and its key ID is the GitLab username.
+type certChecker struct {
+	checker    *ssh.CertChecker
+	principals []string
+}
+
+func newCertChecker(cfg *config.Config) (*certChecker, error) {
+	if cfg.Server.TrustedUserCAKeys == "" {
+		return nil, nil
+	}
+
+	caKeys, err := loadTrustedUserCAKeys(cfg.Server.TrustedUserCAKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, caKey := range caKeys {
+				if bytes.Equal(caKey.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+
+			return false
+		},
+	}
+
+	return &certChecker{checker: checker, principals: cfg.Server.AuthorizedPrincipals}, nil
+}
+
+func loadTrustedUserCAKeys(filename string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %v: %w", filename, err)
+		}
+
+		keys = append(keys, key)
+		data = rest
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %v", filename)
+	}
+
+	return keys, nil
+}
+
+// Authenticate validates the certificate and returns the permissions of the
+// connection. Critical options other than source-address are rejected, and
+// source-address itself is enforced by the SSH library.
+func (c *certChecker) Authenticate(cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if c == nil {
+		return nil, errors.New("certificate authentication is disabled")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+	if !c.checker.IsUserAuthority(cert.SignatureKey) {
+		return nil, errors.New("certificate signed by unrecognized authority")
+	}
+	if cert.KeyId == "" {
+		return nil, errors.New("certificate has no key ID")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("certificate has no principals")
+	}
+
+	principal, err := c.findPrincipal(cert)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checker.CheckCert(principal, cert); err != nil {
+		return nil, err
+	}
+
+	return &ssh.Permissions{
+		CriticalOptions: cert.CriticalOptions,
+		// Record the user the certificate was issued for.
+		Extensions: map[string]string{
+			"username": cert.KeyId,
+		},
+	}, nil
+}
+
+func (c *certChecker) findPrincipal(cert *ssh.Certificate) (string, error) {
+	for _, principal := range cert.ValidPrincipals {
+		for _, authorized := range c.principals {
+			if principal == authorized {
+				return principal, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("none of the certificate principals %q is authorized", cert.ValidPrincipals)
+}
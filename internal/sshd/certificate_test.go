@@ -0,0 +1,181 @@
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+func TestNewCertCheckerDisabled(t *testing.T) {
+	checker, err := newCertChecker(&config.Config{})
+	require.NoError(t, err)
+	require.Nil(t, checker)
+
+	_, err = checker.Authenticate(&ssh.Certificate{})
+	require.EqualError(t, err, "certificate authentication is disabled")
+}
+
+func TestNewCertCheckerInvalidFile(t *testing.T) {
+	dir := tempDir(t)
+
+	invalid := filepath.Join(dir, "invalid")
+	require.NoError(t, ioutil.WriteFile(invalid, []byte("not a key\n"), 0644))
+
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, ioutil.WriteFile(empty, []byte("\n"), 0644))
+
+	for _, filename := range []string{invalid, empty, filepath.Join(dir, "missing")} {
+		cfg := &config.Config{Server: config.ServerConfig{TrustedUserCAKeys: filename}}
+
+		_, err := newCertChecker(cfg)
+		require.Error(t, err)
+	}
+}
+
+func TestCertCheckerAuthenticate(t *testing.T) {
+	ca := newSigner(t)
+	otherCA := newSigner(t)
+	checker := setupCertChecker(t, ca)
+
+	testCases := []struct {
+		desc          string
+		modify        func(cert *ssh.Certificate)
+		signer        ssh.Signer
+		expectedError string
+	}{
+		{
+			desc: "a valid certificate",
+		},
+		{
+			desc: "a certificate with the source-address option",
+			modify: func(cert *ssh.Certificate) {
+				cert.CriticalOptions = map[string]string{"source-address": "127.0.0.1/32"}
+			},
+		},
+		{
+			desc:          "a certificate signed by an unknown CA",
+			signer:        otherCA,
+			expectedError: "certificate signed by unrecognized authority",
+		},
+		{
+			desc:          "a host certificate",
+			modify:        func(cert *ssh.Certificate) { cert.CertType = ssh.HostCert },
+			expectedError: "certificate has type 2",
+		},
+		{
+			desc:          "a certificate without key ID",
+			modify:        func(cert *ssh.Certificate) { cert.KeyId = "" },
+			expectedError: "certificate has no key ID",
+		},
+		{
+			desc:          "a certificate without principals",
+			modify:        func(cert *ssh.Certificate) { cert.ValidPrincipals = nil },
+			expectedError: "certificate has no principals",
+		},
+		{
+			desc:          "a certificate for an unauthorized principal",
+			modify:        func(cert *ssh.Certificate) { cert.ValidPrincipals = []string{"admins"} },
+			expectedError: `none of the certificate principals ["admins"] is authorized`,
+		},
+		{
+			desc:          "an expired certificate",
+			modify:        func(cert *ssh.Certificate) { cert.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix()) },
+			expectedError: "ssh: cert has expired",
+		},
+		{
+			desc:          "a certificate that is not yet valid",
+			modify:        func(cert *ssh.Certificate) { cert.ValidAfter = uint64(time.Now().Add(time.Hour).Unix()) },
+			expectedError: "ssh: cert is not yet valid",
+		},
+		{
+			desc:          "a certificate with an unsupported critical option",
+			modify:        func(cert *ssh.Certificate) { cert.CriticalOptions = map[string]string{"force-command": "/bin/sh"} },
+			expectedError: `ssh: unsupported critical option "force-command" in certificate`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Key:             newSigner(t).PublicKey(),
+				CertType:        ssh.UserCert,
+				KeyId:           "alex-doe",
+				ValidPrincipals: []string{"other", "gitlab-users"},
+				ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+				ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+			}
+			if tc.modify != nil {
+				tc.modify(cert)
+			}
+
+			signer := tc.signer
+			if signer == nil {
+				signer = ca
+			}
+			require.NoError(t, cert.SignCert(rand.Reader, signer))
+
+			permissions, err := checker.Authenticate(cert)
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+				require.Nil(t, permissions)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "alex-doe", permissions.Extensions["username"])
+			require.Equal(t, cert.CriticalOptions, permissions.CriticalOptions)
+		})
+	}
+}
+
+func setupCertChecker(t *testing.T, ca ssh.Signer) *certChecker {
+	t.Helper()
+
+	caFile := filepath.Join(tempDir(t), "trusted_user_ca_keys.pub")
+	data := append([]byte("# CA keys\n"), ssh.MarshalAuthorizedKey(newSigner(t).PublicKey())...)
+	data = append(data, ssh.MarshalAuthorizedKey(ca.PublicKey())...)
+	require.NoError(t, ioutil.WriteFile(caFile, data, 0644))
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{
+			TrustedUserCAKeys:    caFile,
+			AuthorizedPrincipals: []string{"gitlab-users"},
+		},
+	}
+
+	checker, err := newCertChecker(cfg)
+	require.NoError(t, err)
+
+	return checker
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	return signer
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "gitlab-sshd-test-")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
@@ -0,0 +1,128 @@
+package sshd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// These requests implement the OpenSSH host key rotation extension. The server
+// announces all of its host keys after authentication, and the client can ask
+// the server to prove that it owns the keys it didn't know about. See
+// PROTOCOL in the OpenSSH sources, section 2.5.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+func announceHostKeys(conn *ssh.ServerConn, hostKeys []ssh.Signer) {
+	var keys [][]byte
+	for _, key := range hostKeys {
+		keys = append(keys, key.PublicKey().Marshal())
+	}
+
+	if _, _, err := conn.SendRequest(hostKeysRequest, false, marshalStrings(keys)); err != nil {
+		log.Infof("Failed to announce host keys: %v", err)
+	}
+}
+
+func handleGlobalRequests(conn *ssh.ServerConn, reqs <-chan *ssh.Request, hostKeys []ssh.Signer) {
+	for req := range reqs {
+		switch req.Type {
+		case hostKeysProveRequest:
+			signatures, err := proveHostKeys(conn.SessionID(), hostKeys, req.Payload)
+			if err != nil {
+				log.Infof("Failed to prove host keys: %v", err)
+			}
+			if req.WantReply {
+				req.Reply(err == nil, signatures)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// proveHostKeys signs each of the requested host keys along with the session
+// identifier to prove the possession of the private keys.
+func proveHostKeys(sessionID []byte, hostKeys []ssh.Signer, payload []byte) ([]byte, error) {
+	requested, err := unmarshalStrings(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var signatures [][]byte
+	for _, keyBlob := range requested {
+		signer := findHostKey(hostKeys, keyBlob)
+		if signer == nil {
+			return nil, errors.New("unknown host key requested")
+		}
+
+		data := marshalStrings([][]byte{[]byte(hostKeysProveRequest), sessionID, keyBlob})
+		signature, err := signHostKeyProof(signer, data)
+		if err != nil {
+			return nil, err
+		}
+
+		signatures = append(signatures, ssh.Marshal(signature))
+	}
+
+	return marshalStrings(signatures), nil
+}
+
+// signHostKeyProof signs the proof of a host key. OpenSSH clients verify the
+// proofs of RSA keys with an rsa-sha2 algorithm, so they aren't signed with
+// the default ssh-rsa (SHA-1) one.
+func signHostKeyProof(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+	}
+
+	return signer.Sign(rand.Reader, data)
+}
+
+func findHostKey(hostKeys []ssh.Signer, keyBlob []byte) ssh.Signer {
+	for _, key := range hostKeys {
+		if bytes.Equal(key.PublicKey().Marshal(), keyBlob) {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func marshalStrings(values [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, value := range values {
+		binary.Write(&buf, binary.BigEndian, uint32(len(value)))
+		buf.Write(value)
+	}
+
+	return buf.Bytes()
+}
+
+func unmarshalStrings(data []byte) ([][]byte, error) {
+	var values [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("malformed request payload")
+		}
+
+		length := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint64(len(data)) < uint64(length) {
+			return nil, errors.New("malformed request payload")
+		}
+
+		values = append(values, data[:length])
+		data = data[length:]
+	}
+
+	return values, nil
+}
@@ -0,0 +1,114 @@
+package sshd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestHostKeysRotation(t *testing.T) {
+	cfg := buildConfig(t)
+	currentKey := hostKeyFromFile(t, cfg.Server.HostKeyFiles[0])
+
+	// The second key has the same type, so it's only announced
+	nextKeyFile := filepath.Join(filepath.Dir(cfg.Server.HostKeyFiles[0]), "next_hostkey")
+	nextKey := writeHostKey(t, nextKeyFile)
+	cfg.Server.HostKeyFiles = append(cfg.Server.HostKeyFiles, nextKeyFile)
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+	require.Equal(t, currentKey, hostKey(t, s))
+
+	conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", clientConfig(t, s))
+	require.NoError(t, err)
+	defer sshConn.Close()
+	go func() {
+		for newChannel := range chans {
+			newChannel.Reject(ssh.Prohibited, "")
+		}
+	}()
+
+	var announced *ssh.Request
+	select {
+	case announced = <-reqs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("host keys were not announced")
+	}
+	go ssh.DiscardRequests(reqs)
+
+	require.Equal(t, hostKeysRequest, announced.Type)
+	keys, err := unmarshalStrings(announced.Payload)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{currentKey.Marshal(), nextKey.Marshal()}, keys)
+
+	t.Run("proving a known key", func(t *testing.T) {
+		ok, payload, err := sshConn.SendRequest(hostKeysProveRequest, true, marshalStrings([][]byte{nextKey.Marshal()}))
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		signatures, err := unmarshalStrings(payload)
+		require.NoError(t, err)
+		require.Len(t, signatures, 1)
+
+		signature := new(ssh.Signature)
+		require.NoError(t, ssh.Unmarshal(signatures[0], signature))
+
+		data := marshalStrings([][]byte{[]byte(hostKeysProveRequest), sshConn.SessionID(), nextKey.Marshal()})
+		require.NoError(t, nextKey.Verify(data, signature))
+	})
+
+	t.Run("proving an unknown key", func(t *testing.T) {
+		ok, _, err := sshConn.SendRequest(hostKeysProveRequest, true, marshalStrings([][]byte{newSigner(t).PublicKey().Marshal()}))
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("a malformed request", func(t *testing.T) {
+		ok, _, err := sshConn.SendRequest(hostKeysProveRequest, true, []byte{0, 0, 0, 10, 1})
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+}
+
+func TestProveRSAHostKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	sessionID := []byte("session-id")
+	keyBlob := signer.PublicKey().Marshal()
+
+	payload, err := proveHostKeys(sessionID, []ssh.Signer{signer}, marshalStrings([][]byte{keyBlob}))
+	require.NoError(t, err)
+
+	signatures, err := unmarshalStrings(payload)
+	require.NoError(t, err)
+	require.Len(t, signatures, 1)
+
+	signature := new(ssh.Signature)
+	require.NoError(t, ssh.Unmarshal(signatures[0], signature))
+	require.Equal(t, ssh.SigAlgoRSASHA2512, signature.Format)
+
+	data := marshalStrings([][]byte{[]byte(hostKeysProveRequest), sessionID, keyBlob})
+	require.NoError(t, signer.PublicKey().Verify(data, signature))
+}
+
+func hostKeyFromFile(t *testing.T, filename string) ssh.PublicKey {
+	t.Helper()
+
+	keys := loadHostKeys([]string{filename})
+	require.Len(t, keys, 1)
+
+	return keys[0].PublicKey()
+}
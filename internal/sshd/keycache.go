@@ -0,0 +1,151 @@
+package sshd
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/gitlabnet/authorizedkeys"
+)
+
+const (
+	keyCacheHit  = "hit"
+	keyCacheMiss = "miss"
+)
+
+// keyCache is a bounded LRU cache of the authorized key lookups, keyed by the
+// fingerprint of the key. The keys that aren't found are cached as well, for a
+// shorter time. It's safe for concurrent use, and a nil cache is disabled.
+type keyCache struct {
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the entries from the most to the least recently used.
+	order *list.List
+}
+
+type keyCacheEntry struct {
+	fingerprint string
+	// Either the response of the lookup, or the error when the key wasn't
+	// found.
+	res       *authorizedkeys.Response
+	err       error
+	expiresAt time.Time
+}
+
+// newKeyCache returns nil when the cache is disabled.
+func newKeyCache(cfg *config.ServerConfig) *keyCache {
+	if cfg.KeyCacheSize <= 0 {
+		return nil
+	}
+
+	return &keyCache{
+		size:        cfg.KeyCacheSize,
+		ttl:         cfg.KeyCacheTTL(),
+		negativeTTL: cfg.KeyCacheNegativeTTL(),
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+	}
+}
+
+// get returns the cached lookup of a key, if it hasn't expired.
+func (c *keyCache) get(fingerprint string) (*keyCacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[fingerprint]
+	if !ok {
+		sshdKeyCacheLookups.WithLabelValues(keyCacheMiss).Inc()
+		return nil, false
+	}
+
+	entry := elem.Value.(*keyCacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.removeLocked(elem)
+		sshdKeyCacheLookups.WithLabelValues(keyCacheMiss).Inc()
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	sshdKeyCacheLookups.WithLabelValues(keyCacheHit).Inc()
+
+	return entry, true
+}
+
+// add caches the result of a lookup. err must only be set when the key
+// wasn't found, other errors aren't cached.
+func (c *keyCache) add(fingerprint string, res *authorizedkeys.Response, err error) {
+	if c == nil {
+		return
+	}
+
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &keyCacheEntry{fingerprint: fingerprint, res: res, err: err, expiresAt: c.now().Add(ttl)}
+
+	if elem, ok := c.entries[fingerprint]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[fingerprint] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.size {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+// invalidate removes a key from the cache, and reports whether it was cached.
+func (c *keyCache) invalidate(fingerprint string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[fingerprint]
+	if ok {
+		c.removeLocked(elem)
+	}
+
+	return ok
+}
+
+// purge removes all the keys from the cache.
+func (c *keyCache) purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+func (c *keyCache) removeLocked(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*keyCacheEntry).fingerprint)
+}
@@ -0,0 +1,257 @@
+package sshd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/gitlabnet/authorizedkeys"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/keyline"
+)
+
+func TestKeyCacheDisabled(t *testing.T) {
+	c := newKeyCache(&config.ServerConfig{KeyCacheTTLSeconds: 60})
+	require.Nil(t, c)
+
+	c.add("SHA256:key", &authorizedkeys.Response{Id: 1}, nil)
+	_, ok := c.get("SHA256:key")
+	require.False(t, ok)
+	require.False(t, c.invalidate("SHA256:key"))
+	c.purge()
+}
+
+func TestKeyCache(t *testing.T) {
+	now := time.Now()
+	c := newKeyCache(&config.ServerConfig{
+		KeyCacheSize:               2,
+		KeyCacheTTLSeconds:         60,
+		KeyCacheNegativeTTLSeconds: 10,
+	})
+	c.now = func() time.Time { return now }
+
+	notFound := errors.New("not found")
+	c.add("SHA256:first", &authorizedkeys.Response{Id: 1}, nil)
+	c.add("SHA256:unknown", nil, notFound)
+
+	entry, ok := c.get("SHA256:first")
+	require.True(t, ok)
+	require.Equal(t, int64(1), entry.res.Id)
+
+	entry, ok = c.get("SHA256:unknown")
+	require.True(t, ok)
+	require.Equal(t, notFound, entry.err)
+
+	t.Run("negative entries expire first", func(t *testing.T) {
+		now = now.Add(10 * time.Second)
+
+		_, ok := c.get("SHA256:unknown")
+		require.False(t, ok)
+		_, ok = c.get("SHA256:first")
+		require.True(t, ok)
+	})
+
+	t.Run("least recently used entries are evicted", func(t *testing.T) {
+		c.add("SHA256:second", &authorizedkeys.Response{Id: 2}, nil)
+		_, ok := c.get("SHA256:first")
+		require.True(t, ok)
+
+		c.add("SHA256:third", &authorizedkeys.Response{Id: 3}, nil)
+
+		_, ok = c.get("SHA256:second")
+		require.False(t, ok)
+		_, ok = c.get("SHA256:first")
+		require.True(t, ok)
+		_, ok = c.get("SHA256:third")
+		require.True(t, ok)
+	})
+
+	t.Run("entries expire", func(t *testing.T) {
+		now = now.Add(time.Minute)
+
+		_, ok := c.get("SHA256:first")
+		require.False(t, ok)
+	})
+
+	t.Run("invalidation", func(t *testing.T) {
+		c.add("SHA256:first", &authorizedkeys.Response{Id: 1}, nil)
+		c.add("SHA256:second", &authorizedkeys.Response{Id: 2}, nil)
+
+		require.True(t, c.invalidate("SHA256:first"))
+		require.False(t, c.invalidate("SHA256:first"))
+		_, ok := c.get("SHA256:first")
+		require.False(t, ok)
+
+		c.purge()
+		_, ok = c.get("SHA256:second")
+		require.False(t, ok)
+	})
+}
+
+func TestKeyCacheMetrics(t *testing.T) {
+	c := newKeyCache(&config.ServerConfig{KeyCacheSize: 1, KeyCacheTTLSeconds: 60})
+
+	hits := sshdKeyCacheLookups.WithLabelValues(keyCacheHit)
+	misses := sshdKeyCacheLookups.WithLabelValues(keyCacheMiss)
+	hitsBefore, missesBefore := testutil.ToFloat64(hits), testutil.ToFloat64(misses)
+
+	c.get("SHA256:key")
+	c.add("SHA256:key", &authorizedkeys.Response{Id: 1}, nil)
+	c.get("SHA256:key")
+	c.get("SHA256:key")
+
+	require.Equal(t, hitsBefore+2, testutil.ToFloat64(hits))
+	require.Equal(t, missesBefore+1, testutil.ToFloat64(misses))
+}
+
+func TestKeyCacheLookups(t *testing.T) {
+	var lookups int32
+	cfg := buildConfig(t)
+	cfg.GitlabUrl = testserver.StartHttpServer(t, []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&lookups, 1)
+				json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "key": r.FormValue("key")})
+			},
+		},
+	})
+	cfg.Server.KeyCacheSize = 10
+	cfg.Secret = "sssh, it's a secret"
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	clientCfg := clientConfig(t, s)
+	connect := func() {
+		client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+		require.NoError(t, err)
+		client.Close()
+	}
+
+	connect()
+	connect()
+	require.Equal(t, int32(1), atomic.LoadInt32(&lookups))
+
+	r := httptest.NewRequest(http.MethodDelete, "/key_cache", nil)
+	r.Header.Set("Gitlab-Shared-Secret", base64.StdEncoding.EncodeToString([]byte(cfg.Secret)))
+	w := httptest.NewRecorder()
+	s.MonitoringServeMux().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	connect()
+	require.Equal(t, int32(2), atomic.LoadInt32(&lookups))
+}
+
+func TestKeyCacheEndpoint(t *testing.T) {
+	s := NewServer(buildConfig(t))
+	s.Config.Server.KeyCacheSize = 10
+	s.Config.Secret = "sssh, it's a secret\n"
+	require.NoError(t, s.Reload())
+
+	keys := s.getServerConfig().keys
+	keys.add("SHA256:first", &authorizedkeys.Response{Id: 1}, nil)
+	keys.add("SHA256:second", &authorizedkeys.Response{Id: 2}, nil)
+
+	mux := s.MonitoringServeMux()
+
+	r := httptest.NewRequest(http.MethodGet, "/key_cache", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	// The requests without the shared secret are rejected, even from the
+	// local host
+	for _, header := range []string{"", "c2Vzc2gsIGl0J3MgYSBzZWNyZXQ=", "not base64"} {
+		r = httptest.NewRequest(http.MethodDelete, "/key_cache", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set("Gitlab-Shared-Secret", header)
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	_, ok := keys.get("SHA256:first")
+	require.True(t, ok)
+
+	r = httptest.NewRequest(http.MethodDelete, "/key_cache?fingerprint=SHA256:first", nil)
+	r.Header.Set("Gitlab-Shared-Secret", base64.StdEncoding.EncodeToString([]byte("sssh, it's a secret")))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, ok = keys.get("SHA256:first")
+	require.False(t, ok)
+	_, ok = keys.get("SHA256:second")
+	require.True(t, ok)
+}
+
+func TestKeyCacheKeptOnReload(t *testing.T) {
+	s := NewServer(buildConfig(t))
+	s.Config.Server.KeyCacheSize = 10
+	require.NoError(t, s.Reload())
+
+	s.getServerConfig().keys.add("SHA256:key", &authorizedkeys.Response{Id: 1}, nil)
+
+	require.NoError(t, s.Reload())
+	_, ok := s.getServerConfig().keys.get("SHA256:key")
+	require.True(t, ok, "the lookups must be kept when the keys are reloaded")
+}
+
+func TestKeyCacheSkipsAuthFile(t *testing.T) {
+	var available int32
+	cfg := buildConfig(t)
+	cfg.GitlabUrl = testserver.StartHttpServer(t, []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				if atomic.LoadInt32(&available) == 0 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				// The key was removed while the API was unavailable
+				w.WriteHeader(http.StatusNotFound)
+			},
+		},
+	})
+	cfg.HttpSettings.Retries = 0
+	cfg.Server.KeyCacheSize = 10
+	cfg.RootDir = "/tmp"
+	cfg.AuthFile = filepath.Join(tempDir(t), "authorized_keys")
+	cfg.AuthFileFallback = true
+
+	_, privKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(privKey)
+	require.NoError(t, err)
+
+	keyLine, err := keyline.NewPublicKeyLine("1", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), cfg)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(cfg.AuthFile, []byte(keyLine.ToString()+"\n"), 0600))
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	clientCfg := clientConfig(t, s)
+	clientCfg.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+
+	client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+	require.NoError(t, err)
+	client.Close()
+
+	// The API decides again once it's back
+	atomic.StoreInt32(&available, 1)
+	_, err = ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+	require.Error(t, err)
+}
@@ -0,0 +1,202 @@
+package sshd
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+const (
+	limitReasonMaxConnections      = "max_connections"
+	limitReasonMaxConnectionsPerIP = "max_connections_per_ip"
+	limitReasonRate                = "connection_rate"
+	limitReasonBanned              = "banned"
+
+	// Per-IP state that has been unused for this long is dropped.
+	limiterSweepInterval = time.Minute
+)
+
+// connectionLimiter enforces the connection limits of the server, and bans
+// sources that repeatedly fail to authenticate. It's safe for concurrent use.
+type connectionLimiter struct {
+	cfg config.ConnectionLimitsConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	total     int64
+	sources   map[string]*sourceState
+	lastSweep time.Time
+}
+
+type sourceState struct {
+	connections int64
+
+	tokens     float64
+	lastRefill time.Time
+
+	authFailures    int64
+	firstFailure    time.Time
+	bannedUntil     time.Time
+	lastConnectedAt time.Time
+}
+
+func newConnectionLimiter(cfg config.ConnectionLimitsConfig) *connectionLimiter {
+	return &connectionLimiter{
+		cfg:     cfg,
+		now:     time.Now,
+		sources: make(map[string]*sourceState),
+	}
+}
+
+// acquire registers a new connection from ip. If one of the limits is hit,
+// it returns the reason and the connection must be closed. Otherwise, the
+// returned function must be called once the connection is closed.
+func (l *connectionLimiter) acquire(ip string) (func(), string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	source := l.source(ip, now)
+	source.lastConnectedAt = now
+
+	if now.Before(source.bannedUntil) {
+		return nil, limitReasonBanned
+	}
+	if l.cfg.MaxConnections > 0 && l.total >= l.cfg.MaxConnections {
+		return nil, limitReasonMaxConnections
+	}
+	if l.cfg.MaxConnectionsPerIP > 0 && source.connections >= l.cfg.MaxConnectionsPerIP {
+		return nil, limitReasonMaxConnectionsPerIP
+	}
+	if !l.takeToken(source, now) {
+		return nil, limitReasonRate
+	}
+
+	l.total++
+	source.connections++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.total--
+			source.connections--
+		})
+	}
+
+	return release, ""
+}
+
+// takeToken implements a token bucket holding up to ConnectionBurstPerIP
+// tokens and refilled at ConnectionRatePerIP tokens per second.
+func (l *connectionLimiter) takeToken(source *sourceState, now time.Time) bool {
+	if l.cfg.ConnectionRatePerIP <= 0 {
+		return true
+	}
+
+	burst := float64(l.cfg.ConnectionBurstPerIP)
+	if burst < 1 {
+		burst = 1
+	}
+
+	if source.lastRefill.IsZero() {
+		source.tokens = burst
+	} else {
+		source.tokens += now.Sub(source.lastRefill).Seconds() * l.cfg.ConnectionRatePerIP
+		if source.tokens > burst {
+			source.tokens = burst
+		}
+	}
+	source.lastRefill = now
+
+	if source.tokens < 1 {
+		return false
+	}
+
+	source.tokens--
+
+	return true
+}
+
+// authFailed records a failed authentication attempt from ip. It reports
+// whether this attempt caused the source to be banned.
+func (l *connectionLimiter) authFailed(ip string) bool {
+	if l.cfg.MaxAuthFailuresPerIP <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	source := l.source(ip, now)
+
+	window := l.cfg.AuthFailureBanDuration()
+	if source.authFailures == 0 || now.Sub(source.firstFailure) > window {
+		source.authFailures = 0
+		source.firstFailure = now
+	}
+
+	source.authFailures++
+	if source.authFailures < l.cfg.MaxAuthFailuresPerIP {
+		return false
+	}
+
+	source.authFailures = 0
+	source.bannedUntil = now.Add(window)
+
+	return true
+}
+
+func (l *connectionLimiter) isBanned(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	source, ok := l.sources[ip]
+
+	return ok && l.now().Before(source.bannedUntil)
+}
+
+func (l *connectionLimiter) source(ip string, now time.Time) *sourceState {
+	source, ok := l.sources[ip]
+	if !ok {
+		source = &sourceState{lastConnectedAt: now}
+		l.sources[ip] = source
+	}
+
+	return source
+}
+
+// sweep drops the state of sources that have no connections, aren't banned
+// and haven't connected recently, so that the state doesn't grow forever.
+func (l *connectionLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, source := range l.sources {
+		if source.connections > 0 || now.Before(source.bannedUntil) {
+			continue
+		}
+		if now.Sub(source.lastConnectedAt) < l.cfg.AuthFailureBanDuration()+limiterSweepInterval {
+			continue
+		}
+
+		delete(l.sources, ip)
+	}
+}
+
+func ipFromAddr(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+
+	return addr.String()
+}
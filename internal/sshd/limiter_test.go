@@ -0,0 +1,237 @@
+package sshd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newTestLimiter(cfg config.ConnectionLimitsConfig) (*connectionLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+
+	limiter := newConnectionLimiter(cfg)
+	limiter.now = clock.Now
+
+	return limiter, clock
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	limiter, _ := newTestLimiter(config.ConnectionLimitsConfig{})
+
+	for i := 0; i < 100; i++ {
+		_, reason := limiter.acquire("127.0.0.1")
+		require.Empty(t, reason)
+	}
+}
+
+func TestLimiterMaxConnections(t *testing.T) {
+	limiter, _ := newTestLimiter(config.ConnectionLimitsConfig{MaxConnections: 2})
+
+	release, reason := limiter.acquire("10.0.0.1")
+	require.Empty(t, reason)
+	_, reason = limiter.acquire("10.0.0.2")
+	require.Empty(t, reason)
+
+	_, reason = limiter.acquire("10.0.0.3")
+	require.Equal(t, limitReasonMaxConnections, reason)
+
+	release()
+	release() // releasing twice has no effect
+
+	_, reason = limiter.acquire("10.0.0.3")
+	require.Empty(t, reason)
+	_, reason = limiter.acquire("10.0.0.4")
+	require.Equal(t, limitReasonMaxConnections, reason)
+}
+
+func TestLimiterMaxConnectionsPerIP(t *testing.T) {
+	limiter, _ := newTestLimiter(config.ConnectionLimitsConfig{MaxConnectionsPerIP: 1})
+
+	release, reason := limiter.acquire("10.0.0.1")
+	require.Empty(t, reason)
+
+	_, reason = limiter.acquire("10.0.0.1")
+	require.Equal(t, limitReasonMaxConnectionsPerIP, reason)
+
+	_, reason = limiter.acquire("10.0.0.2")
+	require.Empty(t, reason)
+
+	release()
+
+	_, reason = limiter.acquire("10.0.0.1")
+	require.Empty(t, reason)
+}
+
+func TestLimiterConnectionRate(t *testing.T) {
+	limiter, clock := newTestLimiter(config.ConnectionLimitsConfig{ConnectionRatePerIP: 2, ConnectionBurstPerIP: 3})
+
+	for i := 0; i < 3; i++ {
+		_, reason := limiter.acquire("10.0.0.1")
+		require.Empty(t, reason)
+	}
+
+	_, reason := limiter.acquire("10.0.0.1")
+	require.Equal(t, limitReasonRate, reason)
+
+	// Other sources have their own bucket
+	_, reason = limiter.acquire("10.0.0.2")
+	require.Empty(t, reason)
+
+	clock.Advance(500 * time.Millisecond)
+
+	_, reason = limiter.acquire("10.0.0.1")
+	require.Empty(t, reason)
+	_, reason = limiter.acquire("10.0.0.1")
+	require.Equal(t, limitReasonRate, reason)
+
+	// The bucket doesn't fill up above the burst
+	clock.Advance(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		_, reason := limiter.acquire("10.0.0.1")
+		require.Empty(t, reason)
+	}
+	_, reason = limiter.acquire("10.0.0.1")
+	require.Equal(t, limitReasonRate, reason)
+}
+
+func TestLimiterAuthFailureBan(t *testing.T) {
+	limiter, clock := newTestLimiter(config.ConnectionLimitsConfig{MaxAuthFailuresPerIP: 3, AuthFailureBanSeconds: 60})
+
+	require.False(t, limiter.authFailed("10.0.0.1"))
+	require.False(t, limiter.authFailed("10.0.0.1"))
+
+	// Failures older than the ban duration are forgotten
+	clock.Advance(61 * time.Second)
+	require.False(t, limiter.authFailed("10.0.0.1"))
+	require.False(t, limiter.authFailed("10.0.0.1"))
+	require.False(t, limiter.isBanned("10.0.0.1"))
+
+	require.True(t, limiter.authFailed("10.0.0.1"))
+	require.True(t, limiter.isBanned("10.0.0.1"))
+	require.False(t, limiter.isBanned("10.0.0.2"))
+
+	_, reason := limiter.acquire("10.0.0.1")
+	require.Equal(t, limitReasonBanned, reason)
+
+	clock.Advance(61 * time.Second)
+	require.False(t, limiter.isBanned("10.0.0.1"))
+
+	_, reason = limiter.acquire("10.0.0.1")
+	require.Empty(t, reason)
+}
+
+func TestLimiterAuthFailureBanDisabled(t *testing.T) {
+	limiter, _ := newTestLimiter(config.ConnectionLimitsConfig{AuthFailureBanSeconds: 60})
+
+	for i := 0; i < 100; i++ {
+		require.False(t, limiter.authFailed("10.0.0.1"))
+	}
+	require.False(t, limiter.isBanned("10.0.0.1"))
+}
+
+func TestLimiterSweep(t *testing.T) {
+	limiter, clock := newTestLimiter(config.ConnectionLimitsConfig{MaxConnectionsPerIP: 1})
+
+	release, _ := limiter.acquire("10.0.0.1")
+	limiter.acquire("10.0.0.2")
+	release()
+
+	clock.Advance(2 * limiterSweepInterval)
+	limiter.acquire("10.0.0.3")
+
+	require.NotContains(t, limiter.sources, "10.0.0.1")
+	// A source with an open connection is kept
+	require.Contains(t, limiter.sources, "10.0.0.2")
+	require.Contains(t, limiter.sources, "10.0.0.3")
+}
+
+func TestServerBansAfterAuthFailures(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.MaxAuthFailuresPerIP = 2
+	cfg.Server.AuthFailureBanSeconds = 60
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	clientCfg := clientConfig(t, s)
+	clientCfg.User = "unknown"
+
+	for i := 0; i < 2; i++ {
+		_, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+		require.Error(t, err)
+	}
+	require.True(t, s.listeners[0].limiter.isBanned("127.0.0.1"))
+
+	// Connections from a banned source are closed right away
+	conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.False(t, isTimeout(err))
+}
+
+func TestServerDoesNotBanOnAPIErrors(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.GitlabUrl = testserver.StartHttpServer(t, []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		},
+	})
+	cfg.Server.MaxAuthFailuresPerIP = 2
+	cfg.Server.AuthFailureBanSeconds = 60
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	for i := 0; i < 3; i++ {
+		_, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientConfig(t, s))
+		require.Error(t, err)
+	}
+	require.False(t, s.listeners[0].limiter.isBanned("127.0.0.1"))
+}
+
+func TestServerMaxConnectionsPerIP(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.MaxConnectionsPerIP = 1
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	_, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientConfig(t, s))
+	require.Error(t, err)
+
+	client.Close()
+
+	require.Eventually(t, func() bool {
+		client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientConfig(t, s))
+		if err != nil {
+			return false
+		}
+		client.Close()
+
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
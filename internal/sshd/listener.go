@@ -0,0 +1,160 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pires/go-proxyproto"
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+// listener accepts the connections of one of the configured listeners. Each
+// listener applies its own PROXY protocol settings and connection limits.
+type listener struct {
+	net.Listener
+
+	name    string
+	limiter *connectionLimiter
+	// socket is the listening socket, without the PROXY protocol.
+	socket net.Listener
+}
+
+// newListener creates the listener of the given configuration. When socket is
+// set, the listener uses this socket, which was inherited from systemd or from
+// the previous process, instead of binding the address.
+func newListener(cfg config.ListenerConfig, socket net.Listener) (*listener, error) {
+	logger := log.WithFields(log.Fields{"listener": cfg.Name})
+
+	if socket == nil {
+		if cfg.Network == "unix" {
+			removeStaleSocket(cfg.Listen)
+		}
+
+		var err error
+		socket, err = net.Listen(cfg.Network, cfg.Listen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for connection: %w", err)
+		}
+	} else {
+		logger.Info("Using an inherited socket")
+	}
+
+	sshListener := socket
+
+	if cfg.ProxyProtocol {
+		policy, err := proxyPolicy(cfg)
+		if err != nil {
+			socket.Close()
+			return nil, fmt.Errorf("invalid PROXY protocol configuration of listener %q: %w", cfg.Name, err)
+		}
+
+		sshListener = &proxyproto.Listener{Listener: sshListener, Policy: policy}
+
+		logger.Info("Proxy protocol is enabled")
+	}
+
+	logger.Infof("Listening on %v", sshListener.Addr().String())
+
+	return &listener{
+		Listener: sshListener,
+		name:     cfg.Name,
+		limiter:  newConnectionLimiter(cfg.ConnectionLimitsConfig),
+		socket:   socket,
+	}, nil
+}
+
+// readProxyHeader reads the PROXY header of a connection accepted by a
+// listener using the PROXY protocol, and returns the error of the header.
+// Without it, the header is only read when the address of the client is first
+// needed, and the error only shows up once the handshake fails.
+func readProxyHeader(nconn net.Conn) error {
+	proxyConn, ok := nconn.(*proxyproto.Conn)
+	if !ok {
+		return nil
+	}
+
+	// Reading nothing waits for the header, without consuming any of the
+	// data sent after it.
+	_, err := proxyConn.Read(nil)
+
+	return err
+}
+
+// socketFile returns a duplicate of the file descriptor of a listening
+// socket, to pass it to another process.
+func socketFile(name string, socket net.Listener) (*os.File, error) {
+	fileSocket, ok := socket.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("the socket of listener %q can't be passed to another process", name)
+	}
+
+	return fileSocket.File()
+}
+
+// handOver keeps the socket file of a Unix socket listener when it's closed,
+// once the socket was passed to another process.
+func (l *listener) handOver() {
+	if unixListener, ok := l.socket.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+}
+
+// removeStaleSocket removes the socket left behind by a previous process that
+// didn't shut down cleanly, so that the address can be bound again.
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.WithError(err).Warnf("Failed to remove stale socket %v", path)
+	}
+}
+
+// proxyPolicy decides whether the PROXY header of an upstream is trusted. When
+// an allowlist is configured, only the listed sources may send a PROXY header
+// and connections from any other source sending one are rejected.
+func proxyPolicy(cfg config.ListenerConfig) (proxyproto.PolicyFunc, error) {
+	if len(cfg.ProxyAllowed) > 0 {
+		allowlist, err := proxyproto.StrictWhiteListPolicy(cfg.ProxyAllowed)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(upstream net.Addr) (proxyproto.Policy, error) {
+			// The allowlist can't match the peers without an IP address, like
+			// the ones of a Unix socket. An error would make the listener
+			// close the connection, so their PROXY headers are rejected
+			// instead, like the ones of any other source not listed.
+			if _, ok := upstream.(*net.TCPAddr); !ok {
+				return proxyproto.REJECT, nil
+			}
+
+			return allowlist(upstream)
+		}, nil
+	}
+
+	switch strings.ToLower(cfg.ProxyPolicy) {
+	case "", "use":
+		return staticProxyPolicy(proxyproto.USE), nil
+	case "require":
+		return staticProxyPolicy(proxyproto.REQUIRE), nil
+	case "ignore":
+		return staticProxyPolicy(proxyproto.IGNORE), nil
+	case "reject":
+		return staticProxyPolicy(proxyproto.REJECT), nil
+	default:
+		return nil, fmt.Errorf("unknown proxy_policy %q", cfg.ProxyPolicy)
+	}
+}
+
+func staticProxyPolicy(policy proxyproto.Policy) proxyproto.PolicyFunc {
+	return func(_ net.Addr) (proxyproto.Policy, error) {
+		return policy, nil
+	}
+}
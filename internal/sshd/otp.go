@@ -0,0 +1,101 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/gitlabnet/twofactorverify"
+)
+
+const (
+	otpPrompt    = "OTP: "
+	otpMaxLength = 64
+
+	otpVerifyTimeout = 10 * time.Second
+)
+
+// otpAuth asks for the one-time password of a connection once the client has
+// proven that it owns its key. The public key authentication is only a partial
+// success, which the keyboard-interactive or password method must complete
+// with a valid password.
+type otpAuth struct {
+	client   *twofactorverify.Client
+	listener *listener
+}
+
+// require wraps the public key callback of a connection so that a valid key
+// is followed by the password.
+func (o *otpAuth) require(ctx context.Context, publicKeyCallback func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		permissions, err := publicKeyCallback(conn, key)
+		if err != nil {
+			return nil, err
+		}
+
+		// The permissions are also returned with the partial success, so
+		// that the source-address option of a certificate still applies.
+		return permissions, &ssh.PartialSuccessError{
+			Next: ssh.ServerAuthCallbacks{
+				KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					answers, err := challenge("", "", []string{otpPrompt}, []bool{false})
+					if err != nil {
+						return nil, err
+					}
+					if len(answers) != 1 {
+						return nil, errors.New("unexpected number of answers")
+					}
+
+					return o.verify(ctx, conn, permissions, answers[0])
+				},
+				PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+					return o.verify(ctx, conn, permissions, string(password))
+				},
+			},
+		}
+	}
+}
+
+// verify checks the password against the user that was authenticated by its
+// key, and completes the authentication with the permissions of the key.
+func (o *otpAuth) verify(ctx context.Context, conn ssh.ConnMetadata, permissions *ssh.Permissions, attempt string) (*ssh.Permissions, error) {
+	ip := ipFromAddr(conn.RemoteAddr())
+	if o.listener.limiter.isBanned(ip) {
+		observeAuthentication(o.listener, authReasonBanned, errBanned)
+		return nil, errBanned
+	}
+
+	if len(attempt) > otpMaxLength {
+		attempt = attempt[:otpMaxLength]
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, otpVerifyTimeout)
+	defer cancel()
+
+	args := &commandargs.Shell{
+		GitlabKeyId:    permissions.Extensions["key-id"],
+		GitlabUsername: permissions.Extensions["username"],
+	}
+
+	err := o.client.VerifyOTP(ctx, args, attempt)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"listener":       o.listener.name,
+			"correlation_id": correlation.ExtractFromContext(ctx),
+			"remote_ip":      ip,
+		}).Info("OTP validation failed")
+		observeAuthentication(o.listener, authReasonInvalidOTP, err)
+		recordAuthFailure(o.listener, ip)
+
+		return nil, err
+	}
+
+	observeAuthentication(o.listener, authReasonOTP, nil)
+
+	return permissions, nil
+}
@@ -0,0 +1,102 @@
+package sshd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+)
+
+func TestRequireOTP(t *testing.T) {
+	cfg := buildConfig(t, testserver.TestRequestHandler{
+		Path: "/api/v4/internal/two_factor_otp_check",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			var requestBody map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&requestBody)
+
+			if requestBody["key_id"] == "1" && requestBody["otp_attempt"] == "123456" {
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+			} else {
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Invalid OTP"})
+			}
+		},
+	})
+	cfg.Server.RequireOTP = true
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	keyboardInteractive := func(answer string) ssh.AuthMethod {
+		return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			require.Equal(t, []string{otpPrompt}, questions)
+			require.Equal(t, []bool{false}, echos)
+
+			return []string{answer}, nil
+		})
+	}
+
+	testCases := []struct {
+		desc          string
+		otpMethod     ssh.AuthMethod
+		expectedError bool
+	}{
+		{
+			desc:      "keyboard-interactive",
+			otpMethod: keyboardInteractive("123456"),
+		},
+		{
+			desc:      "password",
+			otpMethod: ssh.Password("123456"),
+		},
+		{
+			desc:          "invalid OTP",
+			otpMethod:     keyboardInteractive("000000"),
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			// Like OpenSSH by default, the key is tried first
+			clientCfg := clientConfig(t, s)
+			clientCfg.Auth = append(clientCfg.Auth, tc.otpMethod)
+
+			client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+			if tc.expectedError {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "unable to authenticate")
+				return
+			}
+			require.NoError(t, err)
+			defer client.Close()
+
+			session, err := client.NewSession()
+			require.NoError(t, err)
+			require.NoError(t, session.Close())
+		})
+	}
+
+	t.Run("public key only", func(t *testing.T) {
+		_, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientConfig(t, s))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "unable to authenticate")
+	})
+
+	t.Run("OTP without a valid key", func(t *testing.T) {
+		var asked bool
+		clientCfg := clientConfig(t, s)
+		clientCfg.User = "unknown"
+		clientCfg.Auth = append(clientCfg.Auth, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			asked = true
+			return []string{"123456"}, nil
+		}))
+
+		_, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+		require.Error(t, err)
+		require.False(t, asked, "the password must only be asked once the key is authenticated")
+	})
+}
@@ -0,0 +1,191 @@
+package sshd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/gitlabnet/healthcheck"
+)
+
+const (
+	readinessPath = "/readiness"
+	livenessPath  = "/liveness"
+	keyCachePath  = "/key_cache"
+
+	sharedSecretHeaderName = "Gitlab-Shared-Secret"
+
+	readinessCheckTimeout = 5 * time.Second
+)
+
+// ErrHandedOver is returned by the monitoring listener once its socket was
+// passed to the new process of an upgrade, which serves the monitoring
+// endpoint from then on.
+var ErrHandedOver = errors.New("the socket was handed over to a new process")
+
+// MonitoringServeMux returns a mux serving the readiness and liveness probes,
+// and the invalidation of the key cache, to be used by the monitoring listener.
+func (s *Server) MonitoringServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(readinessPath, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+		defer cancel()
+
+		if err := s.checkReadiness(ctx); err != nil {
+			log.WithError(err).Debug("Readiness check failed")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "OK")
+	})
+
+	mux.HandleFunc(livenessPath, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	})
+
+	// A DELETE request removes the key with the given SHA256 fingerprint from
+	// the cache, or all the keys without one. Unlike the probes, it must be
+	// authenticated with the shared secret, like the internal API.
+	mux.HandleFunc(keyCachePath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !s.hasSharedSecret(r) {
+			http.Error(w, "invalid or missing "+sharedSecretHeaderName+" header", http.StatusUnauthorized)
+			return
+		}
+
+		serverConfig := s.getServerConfig()
+		if serverConfig == nil {
+			http.Error(w, "host keys are not loaded", http.StatusServiceUnavailable)
+			return
+		}
+
+		if fingerprint := r.URL.Query().Get("fingerprint"); fingerprint != "" {
+			serverConfig.keys.invalidate(fingerprint)
+		} else {
+			serverConfig.keys.purge()
+		}
+
+		fmt.Fprintln(w, "OK")
+	})
+
+	return mux
+}
+
+// ListenMonitoring binds the address of the monitoring endpoint. Like the SSH
+// listeners, it uses the inherited socket when there is one, and the socket is
+// passed to the new process on upgrade. The listener is then closed, and
+// Accept returns ErrHandedOver.
+func (s *Server) ListenMonitoring() (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	socket, err := s.takeInheritedSocket(config.ListenerConfig{
+		Name:    config.MonitoringListenerName,
+		Network: "tcp",
+		Listen:  s.Config.Server.WebListen,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if socket == nil {
+		socket, err = net.Listen("tcp", s.Config.Server.WebListen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.webListener = &monitoringListener{Listener: socket}
+
+	return s.webListener, nil
+}
+
+// monitoringListener stops accepting connections once its socket was handed
+// over to a new process, so that the probes and scrapes aren't served by the
+// process that shuts down.
+type monitoringListener struct {
+	net.Listener
+
+	// handedOver is set to 1 once the socket was passed to the new process.
+	// It's only accessed atomically.
+	handedOver int32
+}
+
+func (l *monitoringListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil && atomic.LoadInt32(&l.handedOver) == 1 {
+		return nil, ErrHandedOver
+	}
+
+	return conn, err
+}
+
+// handOver closes the listener of this process, once the new process has a
+// copy of its socket.
+func (l *monitoringListener) handOver() {
+	atomic.StoreInt32(&l.handedOver, 1)
+	l.Listener.Close()
+}
+
+// hasSharedSecret reports whether a request sends the shared secret, base64
+// encoded in the Gitlab-Shared-Secret header like the requests to the internal
+// API. Like GitLab, the surrounding whitespace of the secret is ignored.
+func (s *Server) hasSharedSecret(r *http.Request) bool {
+	secret := strings.TrimSpace(s.Config.Secret)
+	if secret == "" {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(r.Header.Get(sharedSecretHeaderName))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(string(decoded))), []byte(secret)) == 1
+}
+
+// checkReadiness reports whether the server can handle new connections: the
+// host keys are loaded, the listeners are bound, the server isn't shutting down
+// and the internal API is reachable.
+func (s *Server) checkReadiness(ctx context.Context) error {
+	s.mu.RLock()
+	onShutdown, listeners, serverConfig := s.onShutdown, s.listeners, s.serverConfig
+	s.mu.RUnlock()
+
+	switch {
+	case onShutdown:
+		return errors.New("server is shutting down")
+	case serverConfig == nil:
+		return errors.New("host keys are not loaded")
+	case len(listeners) == 0:
+		return errors.New("not listening yet")
+	}
+
+	client, err := healthcheck.NewClient(s.Config)
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.Check(ctx); err != nil {
+		return fmt.Errorf("internal API check failed: %w", err)
+	}
+
+	return nil
+}
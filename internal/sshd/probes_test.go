@@ -0,0 +1,107 @@
+package sshd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+func TestReadiness(t *testing.T) {
+	checkStatus := http.StatusOK
+	cfg := buildConfig(t, testserver.TestRequestHandler{
+		Path: "/api/v4/internal/check",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			if checkStatus != http.StatusOK {
+				w.WriteHeader(checkStatus)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"api_version": "v4", "redis": true})
+		},
+	})
+
+	s := NewServer(cfg)
+	mux := s.MonitoringServeMux()
+
+	requireReadiness(t, mux, http.StatusServiceUnavailable, "host keys are not loaded")
+
+	require.NoError(t, s.Reload())
+	requireReadiness(t, mux, http.StatusServiceUnavailable, "not listening yet")
+
+	s, _ = startServerWithConfig(t, context.Background(), cfg)
+	mux = s.MonitoringServeMux()
+	requireReadiness(t, mux, http.StatusOK, "OK")
+
+	checkStatus = http.StatusInternalServerError
+	requireReadiness(t, mux, http.StatusServiceUnavailable, "internal API check failed: Internal API error (500)")
+
+	checkStatus = http.StatusOK
+	require.NoError(t, s.Shutdown())
+	requireReadiness(t, mux, http.StatusServiceUnavailable, "server is shutting down")
+}
+
+func TestLiveness(t *testing.T) {
+	s := NewServer(buildConfig(t))
+
+	r := httptest.NewRequest("GET", "/liveness", nil)
+	w := httptest.NewRecorder()
+	s.MonitoringServeMux().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestMonitoringListenerHandOver(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.WebListen = "127.0.0.1:0"
+
+	s := NewServer(cfg)
+	webListener, err := s.ListenMonitoring()
+	require.NoError(t, err)
+
+	served := make(chan error, 1)
+	go func() { served <- http.Serve(webListener, s.MonitoringServeMux()) }()
+
+	// The copy of the socket passed to the new process keeps accepting
+	// connections once this process stopped serving
+	f, err := socketFile(config.MonitoringListenerName, s.webListener.Listener)
+	require.NoError(t, err)
+	defer f.Close()
+
+	s.webListener.handOver()
+
+	select {
+	case err := <-served:
+		require.Equal(t, ErrHandedOver, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the monitoring endpoint is still served")
+	}
+
+	inherited, err := net.FileListener(f)
+	require.NoError(t, err)
+	defer inherited.Close()
+	go http.Serve(inherited, s.MonitoringServeMux())
+
+	response, err := http.Get("http://" + inherited.Addr().String() + livenessPath)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+}
+
+func requireReadiness(t *testing.T, mux *http.ServeMux, status int, body string) {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", "/readiness", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	require.Equal(t, status, w.Code)
+	require.Equal(t, body+"\n", w.Body.String())
+}
@@ -0,0 +1,283 @@
+package sshd
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/client"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/gitlabnet/authorizedkeys"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/gitlabnet/twofactorverify"
+)
+
+var (
+	errBanned          = errors.New("too many authentication failures")
+	errGitCommandsOnly = errors.New("Only git commands are accepted for this SSH user")
+)
+
+// serverConfig holds everything that is derived from key material and can be
+// replaced on reload. Each connection keeps the serverConfig it was accepted
+// with.
+type serverConfig struct {
+	sshConfig *ssh.ServerConfig
+	// hostKeys contains all loaded host keys, including the ones that are
+	// only announced to clients and not used for the key exchange.
+	hostKeys []ssh.Signer
+	// publicKeyCallback authenticates the clients. The requests made to the
+	// GitLab API use the context of the connection, and the failures are
+	// recorded by the limiter of the listener that accepted it.
+	publicKeyCallback func(ctx context.Context, l *listener, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+	// keys caches the authorized key lookups. It's nil when the cache is
+	// disabled.
+	keys *keyCache
+	// otpClient is only set when a one-time password is required.
+	otpClient *twofactorverify.Client
+}
+
+// newServerConfig loads the keys of the configuration. The lookups cached in
+// keys are kept, a new cache is only made when keys is nil.
+func newServerConfig(cfg *config.Config, keys *keyCache) (*serverConfig, error) {
+	authorizedKeysClient, err := authorizedkeys.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize GitLab client: %w", err)
+	}
+
+	certChecker, err := newCertChecker(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trusted user CA keys: %w", err)
+	}
+
+	if keys == nil {
+		keys = newKeyCache(&cfg.Server)
+	}
+
+	// getByKey looks up a key with the API, unless its lookup is cached. The
+	// keys found in the auth_file while the API is unavailable aren't cached,
+	// so that the API decides again once it's back.
+	getByKey := func(ctx context.Context, key ssh.PublicKey) (*authorizedkeys.Response, error) {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if entry, ok := keys.get(fingerprint); ok {
+			return entry.res, entry.err
+		}
+
+		res, err := authorizedKeysClient.GetByKey(ctx, base64.RawStdEncoding.EncodeToString(key.Marshal()))
+		if (err == nil && !res.FromAuthFile) || isKeyNotFound(err) {
+			keys.add(fingerprint, res, err)
+		}
+
+		return res, err
+	}
+
+	// authenticateKey returns the reason reported in the metrics along with
+	// the result.
+	authenticateKey := func(ctx context.Context, key ssh.PublicKey) (*ssh.Permissions, string, error) {
+		if cert, ok := key.(*ssh.Certificate); ok {
+			if err := checkPublicKey(&cfg.Server, cert.Key); err != nil {
+				return nil, rejectedKeyReason(cert.Key), err
+			}
+			permissions, err := certChecker.Authenticate(cert)
+			if err != nil {
+				return nil, authReasonInvalidCertificate, err
+			}
+			return permissions, authReasonCertificate, nil
+		}
+		if err := checkPublicKey(&cfg.Server, key); err != nil {
+			return nil, rejectedKeyReason(key), err
+		}
+		res, err := getByKey(ctx, key)
+		if err != nil {
+			if isKeyNotFound(err) {
+				return nil, authReasonKeyNotFound, err
+			}
+			return nil, authReasonAPIError, err
+		}
+
+		return &ssh.Permissions{
+			// Record the public key used for authentication.
+			Extensions: map[string]string{
+				"key-id": strconv.FormatInt(res.Id, 10),
+			},
+		}, authReasonPublicKey, nil
+	}
+
+	// authenticate checks the login name and then the key, and returns the
+	// reason reported in the metrics along with the result.
+	authenticate := func(ctx context.Context, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, string, error) {
+		user, ok := cfg.SSHUser(conn.User())
+		if !ok {
+			return nil, authReasonUnknownUser, errors.New("unknown user")
+		}
+		permissions, reason, err := authenticateKey(ctx, key)
+		if err != nil {
+			return nil, reason, err
+		}
+		// Record the access given by the login name.
+		permissions.Extensions["ssh-user-access"] = user.Access
+
+		return permissions, reason, nil
+	}
+
+	publicKeyCallback := func(ctx context.Context, l *listener, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		ip := ipFromAddr(conn.RemoteAddr())
+		if l.limiter.isBanned(ip) {
+			observeAuthentication(l, authReasonBanned, errBanned)
+			return nil, errBanned
+		}
+
+		permissions, reason, err := authenticate(ctx, conn, key)
+		observeAuthentication(l, reason, err)
+		// Only the rejected credentials count towards a ban, so that the
+		// clients aren't banned while the API is unavailable.
+		if err != nil && reason != authReasonAPIError {
+			recordAuthFailure(l, ip)
+		}
+
+		return permissions, err
+	}
+
+	sshCfg := &ssh.ServerConfig{
+		Config: ssh.Config{
+			Ciphers:      cfg.Server.Ciphers,
+			KeyExchanges: cfg.Server.KexAlgorithms,
+			MACs:         cfg.Server.MACs,
+		},
+	}
+
+	hostKeys := loadHostKeys(cfg.Server.HostKeyFiles)
+	if len(hostKeys) == 0 {
+		return nil, fmt.Errorf("No host keys could be loaded, aborting")
+	}
+
+	// Like OpenSSH, the first key of each type is used for the key exchange.
+	// The other ones are only announced, so that a new key can be rolled out
+	// to the clients before the old one is removed.
+	usedTypes := make(map[string]bool)
+	for _, key := range hostKeys {
+		keyType := key.PublicKey().Type()
+		if usedTypes[keyType] {
+			continue
+		}
+
+		usedTypes[keyType] = true
+		sshCfg.AddHostKey(key)
+	}
+
+	srvCfg := &serverConfig{
+		sshConfig:         sshCfg,
+		hostKeys:          hostKeys,
+		publicKeyCallback: publicKeyCallback,
+		keys:              keys,
+	}
+
+	if cfg.Server.RequireOTP {
+		srvCfg.otpClient, err = twofactorverify.NewClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize GitLab client: %w", err)
+		}
+	}
+
+	return srvCfg, nil
+}
+
+// forConnection returns the SSH configuration to use for a new connection
+// accepted by l, authenticating the client with the context of the
+// connection. When one-time passwords are required, the password is asked
+// once the key is authenticated.
+func (c *serverConfig) forConnection(ctx context.Context, l *listener) *ssh.ServerConfig {
+	sshCfg := *c.sshConfig
+	sshCfg.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		return c.publicKeyCallback(ctx, l, conn, key)
+	}
+
+	if c.otpClient != nil {
+		otp := &otpAuth{client: c.otpClient, listener: l}
+		sshCfg.PublicKeyCallback = otp.require(ctx, sshCfg.PublicKeyCallback)
+	}
+
+	return &sshCfg
+}
+
+func isKeyNotFound(err error) bool {
+	var apiErr *client.ApiError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func recordAuthFailure(l *listener, ip string) {
+	if l.limiter.authFailed(ip) {
+		log.WithFields(log.Fields{"listener": l.name, "remote_ip": ip}).Warn("Source banned after repeated authentication failures")
+		sshdAuthFailureBans.WithLabelValues(l.name).Inc()
+	}
+}
+
+// checkPublicKey enforces the public key algorithms and the minimum RSA key
+// size. For certificates, it must be called with the certified key.
+func checkPublicKey(cfg *config.ServerConfig, key ssh.PublicKey) error {
+	if key.Type() == ssh.KeyAlgoDSA {
+		return errors.New("DSA is prohibited")
+	}
+	if !cfg.PublicKeyAlgorithmAllowed(key.Type()) {
+		return fmt.Errorf("public key algorithm %v is not allowed", key.Type())
+	}
+	if key.Type() != ssh.KeyAlgoRSA || cfg.MinRSAKeySize <= 0 {
+		return nil
+	}
+
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return errors.New("unable to determine the RSA key size")
+	}
+	rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return errors.New("unable to determine the RSA key size")
+	}
+	if rsaKey.N.BitLen() < cfg.MinRSAKeySize {
+		return fmt.Errorf("RSA key is too small: %d bits, at least %d are required", rsaKey.N.BitLen(), cfg.MinRSAKeySize)
+	}
+
+	return nil
+}
+
+func loadHostKeys(filenames []string) []ssh.Signer {
+	var hostKeys []ssh.Signer
+	for _, filename := range filenames {
+		keyRaw, err := ioutil.ReadFile(filename)
+		if err != nil {
+			log.Warnf("Failed to read host key %v: %v", filename, err)
+			continue
+		}
+		key, err := ssh.ParsePrivateKey(keyRaw)
+		if err != nil {
+			log.Warnf("Failed to parse host key %v: %v", filename, err)
+			continue
+		}
+		hostKeys = append(hostKeys, key)
+	}
+
+	return hostKeys
+}
+
+// checkSSHUserAccess refuses the commands that the deploy_keys users can't
+// run. The /allowed API call rejects their keys that aren't deploy keys, so
+// only the commands checked with it are accepted.
+func checkSSHUserAccess(args *commandargs.Shell) error {
+	if args.SSHUserAccess != config.SSHUserAccessDeployKeys {
+		return nil
+	}
+
+	switch args.CommandType {
+	case commandargs.UploadPack, commandargs.ReceivePack, commandargs.UploadArchive, commandargs.LfsAuthenticate:
+		return nil
+	default:
+		return errGitCommandsOnly
+	}
+}
@@ -0,0 +1,135 @@
+package sshd
+
+import (
+	"context"
+	"crypto/dsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+func TestCheckPublicKey(t *testing.T) {
+	ed25519Key := newSigner(t).PublicKey()
+	rsaKey := newRSAPublicKey(t, 1024)
+
+	var dsaKey dsa.PrivateKey
+	require.NoError(t, dsa.GenerateParameters(&dsaKey.Parameters, rand.Reader, dsa.L1024N160))
+	require.NoError(t, dsa.GenerateKey(&dsaKey, rand.Reader))
+	dsaPublicKey, err := ssh.NewPublicKey(&dsaKey.PublicKey)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc          string
+		cfg           config.ServerConfig
+		key           ssh.PublicKey
+		expectedError string
+	}{
+		{
+			desc: "all algorithms are allowed by default",
+			key:  ed25519Key,
+		},
+		{
+			desc:          "DSA is always prohibited",
+			key:           dsaPublicKey,
+			expectedError: "DSA is prohibited",
+		},
+		{
+			desc: "allowed algorithm",
+			cfg:  config.ServerConfig{PublicKeyAlgorithms: []string{ssh.KeyAlgoED25519}},
+			key:  ed25519Key,
+		},
+		{
+			desc:          "algorithm not allowed",
+			cfg:           config.ServerConfig{PublicKeyAlgorithms: []string{ssh.KeyAlgoRSA}},
+			key:           ed25519Key,
+			expectedError: "public key algorithm ssh-ed25519 is not allowed",
+		},
+		{
+			desc: "RSA key size without a minimum",
+			key:  rsaKey,
+		},
+		{
+			desc: "RSA key large enough",
+			cfg:  config.ServerConfig{MinRSAKeySize: 1024},
+			key:  rsaKey,
+		},
+		{
+			desc:          "RSA key too small",
+			cfg:           config.ServerConfig{MinRSAKeySize: 2048},
+			key:           rsaKey,
+			expectedError: "RSA key is too small: 1024 bits, at least 2048 are required",
+		},
+		{
+			desc: "minimum RSA key size doesn't apply to other keys",
+			cfg:  config.ServerConfig{MinRSAKeySize: 4096},
+			key:  ed25519Key,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := checkPublicKey(&tc.cfg, tc.key)
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedError)
+			}
+		})
+	}
+}
+
+func TestAlgorithmsAreApplied(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.Ciphers = []string{"aes256-ctr"}
+	cfg.Server.KexAlgorithms = []string{"curve25519-sha256@libssh.org"}
+	cfg.Server.MACs = []string{"hmac-sha2-256"}
+	cfg.Server.PublicKeyAlgorithms = []string{ssh.KeyAlgoED25519}
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	client := buildClient(t, s)
+	require.NoError(t, client.Close())
+
+	clientCfg := clientConfig(t, s)
+	clientCfg.Ciphers = []string{"aes128-ctr"}
+	_, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no common algorithm for client to server cipher")
+
+	clientCfg = clientConfig(t, s)
+	clientCfg.MACs = []string{"hmac-sha1"}
+	_, err = ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no common algorithm for client to server MAC")
+
+	rsaSigner, err := ssh.NewSignerFromKey(newRSAPrivateKey(t, 2048))
+	require.NoError(t, err)
+	clientCfg = clientConfig(t, s)
+	clientCfg.Auth = []ssh.AuthMethod{ssh.PublicKeys(rsaSigner)}
+	_, err = ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to authenticate")
+}
+
+func newRSAPrivateKey(t *testing.T, bits int) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	require.NoError(t, err)
+
+	return key
+}
+
+func newRSAPublicKey(t *testing.T, bits int) ssh.PublicKey {
+	t.Helper()
+
+	key, err := ssh.NewPublicKey(&newRSAPrivateKey(t, bits).PublicKey)
+	require.NoError(t, err)
+
+	return key
+}
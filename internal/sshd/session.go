@@ -0,0 +1,93 @@
+package sshd
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The signal sent to clients when the server terminates a session.
+const exitSignalTerm = "TERM"
+
+// terminateMessages are the messages sent along with the exit signal, by
+// session outcome.
+var terminateMessages = map[string]string{
+	sessionOutcomeIdleTimeout: "idle timeout exceeded",
+	sessionOutcomeShutdown:    "server is shutting down",
+}
+
+type exitSignalReq struct {
+	Signal     string
+	CoreDumped bool
+	Message    string
+	Lang       string
+}
+
+// sessionChannel is the channel of a session. It makes sure that the session
+// is only ended once, either when its command exits or when the server
+// terminates it.
+type sessionChannel struct {
+	ssh.Channel
+	stats *sessionStats
+	once  sync.Once
+}
+
+func (c *sessionChannel) exit(exitStatus uint32) {
+	c.once.Do(func() {
+		c.stats.exited(exitStatus)
+		exitSession(c.Channel, exitStatus)
+	})
+}
+
+// terminate ends the session with an exit signal, so that the client knows
+// why it was closed.
+func (c *sessionChannel) terminate(outcome string) {
+	c.once.Do(func() {
+		c.stats.terminated(outcome)
+		terminateSession(c.Channel, terminateMessages[outcome])
+	})
+}
+
+// activeSessions keeps track of the sessions of a connection, so that they can
+// all be terminated before the connection is closed.
+type activeSessions struct {
+	mu         sync.Mutex
+	sessions   map[*sessionChannel]struct{}
+	terminated string
+}
+
+func newActiveSessions() *activeSessions {
+	return &activeSessions{sessions: make(map[*sessionChannel]struct{})}
+}
+
+// add registers a new session. If the connection is already being
+// terminated, the session is terminated right away.
+func (a *activeSessions) add(c *sessionChannel) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.terminated != "" {
+		c.terminate(a.terminated)
+		return
+	}
+
+	a.sessions[c] = struct{}{}
+}
+
+func (a *activeSessions) remove(c *sessionChannel) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.sessions, c)
+}
+
+// terminate terminates all the sessions with the given outcome.
+func (a *activeSessions) terminate(outcome string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.terminated = outcome
+	for c := range a.sessions {
+		c.terminate(outcome)
+	}
+}
@@ -0,0 +1,208 @@
+package sshd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/term"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+const menuPrompt = "> "
+
+// menuCommands are the commands that can be run from the interactive shell.
+var menuCommands = []struct {
+	commandType commandargs.CommandType
+	description string
+}{
+	{commandargs.TwoFactorRecover, "Generate new two-factor recovery codes"},
+	{commandargs.PersonalAccessToken, "Create a personal access token: personal_access_token <name> <scope1[,scope2,...]> [ttl_days]"},
+	{commandargs.TwoFactorVerify, "Verify a one-time password"},
+}
+
+type ptyRequest struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	WidthPx  uint32
+	HeightPx uint32
+	Modes    string
+}
+
+type windowChangeRequest struct {
+	Columns  uint32
+	Rows     uint32
+	WidthPx  uint32
+	HeightPx uint32
+}
+
+// lineReader reads the input of the interactive shell line by line.
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// terminalLines is used when the client requested a pty. The client sends
+// the raw keystrokes, so the terminal takes care of the echo and the line
+// editing.
+type terminalLines struct {
+	terminal *term.Terminal
+}
+
+func (l *terminalLines) readLine(prompt string) (string, error) {
+	l.terminal.SetPrompt(prompt)
+	defer l.terminal.SetPrompt("")
+
+	return l.terminal.ReadLine()
+}
+
+// plainLines is used without a pty, when the client sends whole lines.
+type plainLines struct {
+	reader *bufio.Reader
+	out    io.Writer
+}
+
+func (l *plainLines) readLine(prompt string) (string, error) {
+	fmt.Fprint(l.out, prompt)
+
+	line, err := l.reader.ReadString('\n')
+	if line == "" && err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// lineReaderInput turns a lineReader into the input of a command.
+type lineReaderInput struct {
+	lines lineReader
+	buf   []byte
+}
+
+func (r *lineReaderInput) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		line, err := r.lines.readLine("")
+		if err != nil {
+			return 0, err
+		}
+		r.buf = []byte(line + "\n")
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// interactiveShell is the menu started by a "shell" request when
+// sshd.interactive_shell is enabled.
+type interactiveShell struct {
+	cfg     *config.Config
+	out     io.Writer
+	errOut  io.Writer
+	lines   lineReader
+	newArgs func(execCmd string) *commandargs.Shell
+}
+
+// newInteractiveShell sets up the shell on top of the session. When the client
+// requested a pty, terminal is the size it sent, otherwise nil.
+func newInteractiveShell(cfg *config.Config, rw *readwriter.ReadWriter, terminal *windowChangeRequest, newArgs func(string) *commandargs.Shell) (*interactiveShell, *term.Terminal) {
+	shell := &interactiveShell{cfg: cfg, newArgs: newArgs}
+
+	if terminal == nil {
+		shell.out = rw.Out
+		shell.errOut = rw.ErrOut
+		shell.lines = &plainLines{reader: bufio.NewReader(rw.In), out: rw.Out}
+
+		return shell, nil
+	}
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{rw.In, rw.Out}, "")
+	t.SetSize(int(terminal.Columns), int(terminal.Rows))
+
+	// With a pty, the client merges stderr and stdout anyway.
+	shell.out = t
+	shell.errOut = t
+	shell.lines = &terminalLines{terminal: t}
+
+	return shell, t
+}
+
+// run prints the welcome message and runs the commands entered by the user
+// until the input ends or the user exits.
+func (s *interactiveShell) run(ctx context.Context) {
+	s.runCommand(ctx, "")
+	s.printHelp()
+
+	for {
+		line, err := s.lines.readLine(menuPrompt)
+		if err != nil {
+			return
+		}
+
+		switch line = strings.TrimSpace(line); line {
+		case "":
+		case "help":
+			s.printHelp()
+		case "exit", "quit":
+			return
+		default:
+			s.runCommand(ctx, line)
+		}
+	}
+}
+
+func (s *interactiveShell) printHelp() {
+	fmt.Fprintln(s.out, "Available commands:")
+	for _, c := range menuCommands {
+		fmt.Fprintf(s.out, "  %-23s%v\n", c.commandType, c.description)
+	}
+	fmt.Fprintf(s.out, "  %-23s%v\n", "help", "Show this list")
+	fmt.Fprintf(s.out, "  %-23s%v\n", "exit", "Close the session")
+}
+
+func (s *interactiveShell) runCommand(ctx context.Context, line string) {
+	args := s.newArgs(line)
+	if err := args.ParseCommand(line); err != nil {
+		fmt.Fprintf(s.errOut, "Failed to parse command: %v\n", err.Error())
+		return
+	}
+	if line != "" && !isMenuCommand(args.CommandType) {
+		fmt.Fprintf(s.errOut, "Unknown command: %v\n", args.CommandType)
+		return
+	}
+
+	rw := &readwriter.ReadWriter{
+		Out:    s.out,
+		ErrOut: s.errOut,
+		In:     &lineReaderInput{lines: s.lines},
+	}
+
+	cmd := command.BuildShellCommand(args, s.cfg, rw)
+	if cmd == nil {
+		fmt.Fprintf(s.errOut, "Unknown command: %v\n", args.CommandType)
+		return
+	}
+	if err := cmd.Execute(ctx); err != nil {
+		fmt.Fprintf(s.errOut, "remote: ERROR: %v\n", err.Error())
+	}
+}
+
+func isMenuCommand(commandType commandargs.CommandType) bool {
+	for _, c := range menuCommands {
+		if c.commandType == commandType {
+			return true
+		}
+	}
+
+	return false
+}
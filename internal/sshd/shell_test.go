@@ -0,0 +1,112 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+func TestInteractiveShell(t *testing.T) {
+	s, _ := startServerWithConfig(t, context.Background(), buildShellConfig(t))
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	var output, errOutput bytes.Buffer
+	session.Stdout = &output
+	session.Stderr = &errOutput
+	session.Stdin = bytes.NewBufferString("help\ngit-upload-pack group/repo\n2fa_verify\n123456\nexit\n")
+
+	require.NoError(t, session.Shell())
+	require.NoError(t, session.Wait())
+
+	require.Contains(t, output.String(), "Welcome to GitLab, @alex-doe!\nAvailable commands:\n")
+	require.Contains(t, output.String(), "  2fa_recovery_codes     Generate new two-factor recovery codes\n")
+	require.Equal(t, "Unknown command: git-upload-pack\n", errOutput.String())
+	require.Contains(t, output.String(), "OTP: \nOTP validation successful. Git operations are now allowed.\n")
+}
+
+func TestInteractiveShellWithPty(t *testing.T) {
+	s, _ := startServerWithConfig(t, context.Background(), buildShellConfig(t))
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	var output bytes.Buffer
+	session.Stdout = &output
+	stdin, err := session.StdinPipe()
+	require.NoError(t, err)
+
+	require.NoError(t, session.RequestPty("xterm", 40, 80, ssh.TerminalModes{}))
+	require.NoError(t, session.Shell())
+	require.NoError(t, session.WindowChange(50, 120))
+
+	_, err = stdin.Write([]byte("2fa_verify\r123456\rexit\r"))
+	require.NoError(t, err)
+	require.NoError(t, session.Wait())
+
+	// The terminal echoes the input and uses CRLF line endings
+	require.Contains(t, output.String(), "Welcome to GitLab, @alex-doe!\r\n")
+	require.Contains(t, output.String(), "> 2fa_verify\r\n")
+	require.Contains(t, output.String(), "OTP: 123456\r\n")
+	require.Contains(t, output.String(), "OTP validation successful.")
+}
+
+func TestShellWithoutInteractiveShell(t *testing.T) {
+	cfg := buildShellConfig(t)
+	cfg.Server.InteractiveShell = false
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	require.Error(t, session.RequestPty("xterm", 40, 80, ssh.TerminalModes{}))
+
+	var output bytes.Buffer
+	session.Stdout = &output
+	require.NoError(t, session.Shell())
+	require.NoError(t, session.Wait())
+
+	require.Equal(t, "Welcome to GitLab, @alex-doe!\n", output.String())
+}
+
+func buildShellConfig(t *testing.T) *config.Config {
+	cfg := buildConfig(t,
+		testserver.TestRequestHandler{
+			Path: "/api/v4/internal/discover",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]interface{}{"id": 2, "username": "alex-doe", "name": "Alex Doe"})
+			},
+		},
+		testserver.TestRequestHandler{
+			Path: "/api/v4/internal/two_factor_otp_check",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+			},
+		},
+	)
+	cfg.Server.InteractiveShell = true
+
+	return cfg
+}
@@ -2,14 +2,13 @@ package sshd
 
 import (
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
-	"strconv"
+	"sync"
 	"time"
 
+	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
@@ -17,10 +16,12 @@ import (
 	"gitlab.com/gitlab-org/gitlab-shell/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/command/readwriter"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
-	"gitlab.com/gitlab-org/gitlab-shell/internal/gitlabnet/authorizedkeys"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/handler"
 	"gitlab.com/gitlab-org/gitlab-shell/internal/sshenv"
+	"gitlab.com/gitlab-org/labkit/correlation"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/semaphore"
+	"golang.org/x/term"
 )
 
 const (
@@ -43,91 +44,408 @@ func secondsDurationBuckets() []float64 {
 }
 
 var (
-	sshdConnectionDuration = promauto.NewHistogram(
+	sshdConnectionDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: namespace,
 			Subsystem: sshdSubsystem,
 			Name:      "connection_duration_seconds",
-			Help:      "A histogram of latencies for connections to gitlab-shell sshd.",
+			Help:      "A histogram of latencies for connections to gitlab-shell sshd, by listener.",
 			Buckets:   secondsDurationBuckets(),
 		},
+		[]string{"listener"},
 	)
 
-	sshdHitMaxSessions = promauto.NewCounter(
+	sshdHitMaxSessions = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: sshdSubsystem,
 			Name:      "concurrent_limited_sessions_total",
-			Help:      "The number of times the concurrent sessions limit was hit in gitlab-shell sshd.",
+			Help:      "The number of times the concurrent sessions limit was hit in gitlab-shell sshd, by listener.",
 		},
+		[]string{"listener"},
+	)
+
+	sshdHitConnectionLimits = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      "limited_connections_total",
+			Help:      "The number of connections rejected by gitlab-shell sshd because a connection limit was hit, by listener.",
+		},
+		[]string{"listener", "reason"},
+	)
+
+	sshdAuthFailureBans = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      "auth_failure_bans_total",
+			Help:      "The number of times a source was temporarily banned after repeated authentication failures in gitlab-shell sshd, by listener.",
+		},
+		[]string{"listener"},
+	)
+
+	sshdDisconnects = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      "timed_out_connections_total",
+			Help:      "The number of connections and sessions closed by gitlab-shell sshd because of a timeout, by listener and reason.",
+		},
+		[]string{"listener", "reason"},
+	)
+
+	sshdAuthentications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      "authentications_total",
+			Help:      "The number of authentication attempts in gitlab-shell sshd, by listener, result and reason.",
+		},
+		[]string{"listener", "result", "reason"},
+	)
+
+	sshdSessionDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      "session_duration_seconds",
+			Help:      "A histogram of the duration of sessions in gitlab-shell sshd, by listener, command type and exit status.",
+			Buckets:   secondsDurationBuckets(),
+		},
+		[]string{"listener", "command_type", "exit_status"},
+	)
+
+	sshdTransferredBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      "transferred_bytes_total",
+			Help:      "The number of bytes received from and sent to clients by gitlab-shell sshd, by listener and command type.",
+		},
+		[]string{"listener", "command_type", "direction"},
+	)
+
+	sshdInFlightConnections = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      "in_flight_connections",
+			Help:      "The number of connections currently handled by gitlab-shell sshd, by listener.",
+		},
+		[]string{"listener"},
+	)
+
+	sshdKeyCacheLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      "key_cache_lookups_total",
+			Help:      "The number of lookups in the authorized keys cache of gitlab-shell sshd, by result (hit or miss).",
+		},
+		[]string{"result"},
+	)
+
+	sshdInFlightSessions = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      "in_flight_sessions",
+			Help:      "The number of sessions currently handled by gitlab-shell sshd, by listener.",
+		},
+		[]string{"listener"},
 	)
 )
 
-func Run(cfg *config.Config) error {
-	authorizedKeysClient, err := authorizedkeys.NewClient(cfg)
-	if err != nil {
-		return fmt.Errorf("failed to initialize GitLab client: %w", err)
+type Server struct {
+	Config *config.Config
+
+	onShutdown   bool
+	upgrading    bool
+	mu           sync.RWMutex
+	reloadMu     sync.Mutex
+	wg           sync.WaitGroup
+	listeners    []*listener
+	webListener  *monitoringListener
+	serverConfig *serverConfig
+
+	// The sockets passed by systemd or by the previous process, which are
+	// read from the environment once.
+	inheritOnce sync.Once
+	inherited   []*inheritedListener
+	inheritErr  error
+}
+
+func NewServer(cfg *config.Config) *Server {
+	return &Server{Config: cfg}
+}
+
+// ListenAndServe accepts connections until Shutdown is called. Once the listeners
+// are closed, it waits for all active connections to finish before returning.
+// Canceling ctx terminates the sessions that are still running.
+//
+// The listening sockets passed by systemd socket activation (LISTEN_FDS) or
+// by the previous process during an upgrade are used instead of binding the
+// addresses again.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if err := s.Reload(); err != nil {
+		return err
+	}
+
+	if err := s.listen(); err != nil {
+		return err
+	}
+	defer s.closeListeners()
+
+	notifyReady()
+
+	s.serve(ctx)
+
+	return nil
+}
+
+// Reload loads the host keys and the trusted user CA keys again. New
+// connections use the reloaded keys while established connections are not
+// affected. If the keys can't be loaded, the previous ones are kept. The
+// cached key lookups are kept as well.
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	return s.reloadLocked()
+}
+
+// ReloadConfig reloads the keys like Reload, with the host key files, trusted
+// user CA keys and authorized principals of cfg, which is read again from the
+// configuration file. The other settings of cfg are ignored. If the keys can't
+// be loaded, the previous keys and settings are kept.
+func (s *Server) ReloadConfig(cfg *config.Config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	// The key settings are only read by newServerConfig, which is serialized
+	// by reloadMu.
+	previous := s.Config.Server
+	s.Config.Server.HostKeyFiles = cfg.Server.HostKeyFiles
+	s.Config.Server.TrustedUserCAKeys = cfg.Server.TrustedUserCAKeys
+	s.Config.Server.AuthorizedPrincipals = cfg.Server.AuthorizedPrincipals
+
+	if err := s.reloadLocked(); err != nil {
+		s.Config.Server.HostKeyFiles = previous.HostKeyFiles
+		s.Config.Server.TrustedUserCAKeys = previous.TrustedUserCAKeys
+		s.Config.Server.AuthorizedPrincipals = previous.AuthorizedPrincipals
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) reloadLocked() error {
+	var keys *keyCache
+	if previous := s.getServerConfig(); previous != nil {
+		keys = previous.keys
 	}
 
-	sshListener, err := net.Listen("tcp", cfg.Server.Listen)
+	serverConfig, err := newServerConfig(s.Config, keys)
 	if err != nil {
-		return fmt.Errorf("failed to listen for connection: %w", err)
+		return err
 	}
 
-	log.Infof("Listening on %v", sshListener.Addr().String())
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	config := &ssh.ServerConfig{
-		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			if conn.User() != cfg.User {
-				return nil, errors.New("unknown user")
-			}
-			if key.Type() == ssh.KeyAlgoDSA {
-				return nil, errors.New("DSA is prohibited")
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-			res, err := authorizedKeysClient.GetByKey(ctx, base64.RawStdEncoding.EncodeToString(key.Marshal()))
-			if err != nil {
-				return nil, err
-			}
+	s.serverConfig = serverConfig
 
-			return &ssh.Permissions{
-				// Record the public key used for authentication.
-				Extensions: map[string]string{
-					"key-id": strconv.FormatInt(res.Id, 10),
-				},
-			}, nil
-		},
+	return nil
+}
+
+func (s *Server) getServerConfig() *serverConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.serverConfig
+}
+
+// Shutdown stops accepting new connections. Connections that are already
+// established are left alone so that they can finish.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onShutdown = true
+
+	return s.closeListenersLocked()
+}
+
+func (s *Server) isOnShutdown() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.onShutdown
+}
+
+func (s *Server) listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.onShutdown {
+		return errors.New("server is shutting down")
 	}
 
-	var loadedHostKeys uint
-	for _, filename := range cfg.Server.HostKeyFiles {
-		keyRaw, err := ioutil.ReadFile(filename)
+	defer s.closeUnusedInheritedSockets()
+
+	var listeners []*listener
+	for _, listenerConfig := range s.Config.Server.ListenerConfigs() {
+		socket, err := s.takeInheritedSocket(listenerConfig)
 		if err != nil {
-			log.Warnf("Failed to read host key %v: %v", filename, err)
-			continue
+			return err
 		}
-		key, err := ssh.ParsePrivateKey(keyRaw)
+
+		l, err := newListener(listenerConfig, socket)
 		if err != nil {
-			log.Warnf("Failed to parse host key %v: %v", filename, err)
-			continue
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return err
 		}
-		loadedHostKeys++
-		config.AddHostKey(key)
+
+		listeners = append(listeners, l)
 	}
-	if loadedHostKeys == 0 {
-		return fmt.Errorf("No host keys could be loaded, aborting")
+
+	s.listeners = listeners
+
+	return nil
+}
+
+// takeInheritedSocket returns the inherited socket of the given listener, or
+// nil if there is none. It must be called with s.mu held.
+func (s *Server) takeInheritedSocket(cfg config.ListenerConfig) (net.Listener, error) {
+	s.inheritOnce.Do(func() {
+		s.inherited, s.inheritErr = inheritedListeners()
+	})
+	if s.inheritErr != nil {
+		return nil, s.inheritErr
+	}
+
+	var socket net.Listener
+	socket, s.inherited = takeInheritedListener(s.inherited, cfg)
+
+	return socket, nil
+}
+
+func (s *Server) closeUnusedInheritedSockets() {
+	for _, l := range s.inherited {
+		log.WithFields(log.Fields{"name": l.name, "address": l.Addr().String()}).Warn("Closing an inherited socket that matches no listener")
+		l.Close()
+	}
+
+	s.inherited = nil
+}
+
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closeListenersLocked()
+}
+
+func (s *Server) closeListenersLocked() error {
+	var firstErr error
+	for _, l := range s.listeners {
+		if err := l.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
 
+	return firstErr
+}
+
+func (s *Server) serve(ctx context.Context) {
+	s.mu.RLock()
+	listeners := s.listeners
+	s.mu.RUnlock()
+
+	var accepting sync.WaitGroup
+	for _, l := range listeners {
+		accepting.Add(1)
+		go func(l *listener) {
+			defer accepting.Done()
+
+			s.accept(ctx, l)
+		}(l)
+	}
+	accepting.Wait()
+
+	s.wg.Wait()
+}
+
+// accept handles the connections of a listener until it's closed.
+func (s *Server) accept(ctx context.Context, l *listener) {
 	for {
-		nconn, err := sshListener.Accept()
+		nconn, err := l.Accept()
 		if err != nil {
-			log.Warnf("Failed to accept connection: %v\n", err)
+			if s.isOnShutdown() {
+				return
+			}
+
+			log.WithError(err).WithFields(log.Fields{"listener": l.name}).Warn("Failed to accept connection")
 			continue
 		}
 
-		go handleConn(nconn, config, cfg)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+
+			// The client has to send the PROXY header, complete the handshake
+			// and authenticate within the login grace time. The deadline is
+			// set before the PROXY header is read to apply the connection
+			// limits, so that a client sending nothing can't hold the
+			// connection.
+			if loginGraceTime := s.Config.Server.LoginGraceTime(); loginGraceTime > 0 {
+				nconn.SetDeadline(time.Now().Add(loginGraceTime))
+			}
+
+			release, ok := acquireConn(l, nconn)
+			if !ok {
+				return
+			}
+			defer release()
+
+			handleConn(ctx, l, nconn, s.getServerConfig(), s.Config)
+		}()
+	}
+}
+
+// acquireConn applies the connection limits of the listener to a new
+// connection. It closes the connection when one of the limits is hit.
+func acquireConn(l *listener, nconn net.Conn) (func(), bool) {
+	if err := readProxyHeader(nconn); err != nil {
+		logger := log.WithFields(log.Fields{"listener": l.name, "remote_ip": ipFromAddr(nconn.RemoteAddr())})
+		if isTimeout(err) {
+			logger.Info("Closing connection: login grace time exceeded")
+			sshdDisconnects.WithLabelValues(l.name, disconnectReasonLoginGraceTime).Inc()
+		} else {
+			logger.WithError(err).Info("Failed to read PROXY header")
+		}
+		nconn.Close()
+
+		return nil, false
+	}
+
+	ip := ipFromAddr(nconn.RemoteAddr())
+
+	release, reason := l.limiter.acquire(ip)
+	if reason != "" {
+		log.WithFields(log.Fields{"listener": l.name, "remote_ip": ip, "reason": reason}).Info("Connection rejected because of a connection limit")
+		sshdHitConnectionLimits.WithLabelValues(l.name, reason).Inc()
+		nconn.Close()
+
+		return nil, false
 	}
+
+	return release, true
 }
 
 type execRequest struct {
@@ -143,6 +461,22 @@ type envRequest struct {
 	Value string
 }
 
+// isValidEnvName reports whether name is made of letters, digits and
+// underscores only, so that it can be used as gRPC metadata.
+func isValidEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
 func exitSession(ch ssh.Channel, exitStatus uint32) {
 	exitStatusReq := exitStatusReq{
 		ExitStatus: exitStatus,
@@ -152,24 +486,85 @@ func exitSession(ch ssh.Channel, exitStatus uint32) {
 	ch.Close()
 }
 
-func handleConn(nconn net.Conn, sshCfg *ssh.ServerConfig, cfg *config.Config) {
+func terminateSession(ch ssh.Channel, message string) {
+	exitSignalReq := exitSignalReq{
+		Signal:  exitSignalTerm,
+		Message: message,
+	}
+	ch.CloseWrite()
+	ch.SendRequest("exit-signal", false, ssh.Marshal(exitSignalReq))
+	ch.Close()
+}
+
+// startSpan starts a tracing span with a new correlation ID, which is sent
+// along with the requests made to the GitLab API and to Gitaly.
+func startSpan(ctx context.Context, operationName string) (context.Context, opentracing.Span) {
+	ctx = correlation.ContextWithCorrelation(ctx, correlation.SafeRandomID())
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, operationName)
+	span.SetTag("correlation_id", correlation.ExtractFromContext(ctx))
+
+	return ctx, span
+}
+
+func handleConn(ctx context.Context, l *listener, nconn net.Conn, srvCfg *serverConfig, cfg *config.Config) {
 	begin := time.Now()
+	sshdInFlightConnections.WithLabelValues(l.name).Inc()
 	defer func() {
-		sshdConnectionDuration.Observe(time.Since(begin).Seconds())
+		sshdInFlightConnections.WithLabelValues(l.name).Dec()
+		sshdConnectionDuration.WithLabelValues(l.name).Observe(time.Since(begin).Seconds())
 	}()
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	defer nconn.Close()
-	conn, chans, reqs, err := ssh.NewServerConn(nconn, sshCfg)
+
+	ctx, span := startSpan(ctx, "sshd.connection")
+	defer span.Finish()
+	span.SetTag("remote_ip", ipFromAddr(nconn.RemoteAddr()))
+	span.SetTag("listener", l.name)
+
+	logger := log.WithFields(log.Fields{
+		"listener":       l.name,
+		"correlation_id": correlation.ExtractFromContext(ctx),
+		"remote_ip":      ipFromAddr(nconn.RemoteAddr()),
+	})
+	logger.Debug("Connection accepted")
+
+	conn, chans, reqs, err := ssh.NewServerConn(nconn, srvCfg.forConnection(ctx, l))
 	if err != nil {
-		log.Infof("Failed to initialize SSH connection: %v", err)
+		if isTimeout(err) {
+			logger.Info("Closing connection: login grace time exceeded")
+			sshdDisconnects.WithLabelValues(l.name, disconnectReasonLoginGraceTime).Inc()
+			return
+		}
+
+		logger.WithError(err).Info("Failed to initialize SSH connection")
 		return
 	}
+	nconn.SetDeadline(time.Time{})
+
+	go keepAlive(ctx, l, conn, cfg.Server.ClientAliveInterval(), cfg.Server.ClientAliveCountMax)
+
+	var sessions sync.WaitGroup
+	defer sessions.Wait()
+
+	// Once the context is canceled (e.g. the shutdown grace period is over),
+	// terminate the sessions and close the connection so that the client
+	// doesn't keep it open forever. The sessions are all done by the time the
+	// connection is closed normally.
+	active := newActiveSessions()
+	go func() {
+		<-ctx.Done()
+		active.terminate(sessionOutcomeShutdown)
+		conn.Close()
+	}()
 
 	concurrentSessions := semaphore.NewWeighted(cfg.Server.ConcurrentSessionsLimit)
 
-	go ssh.DiscardRequests(reqs)
+	go handleGlobalRequests(conn, reqs, srvCfg.hostKeys)
+	announceHostKeys(conn, srvCfg.hostKeys)
+
 	for newChannel := range chans {
 		if newChannel.ChannelType() != "session" {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
@@ -177,31 +572,95 @@ func handleConn(nconn net.Conn, sshCfg *ssh.ServerConfig, cfg *config.Config) {
 		}
 		if !concurrentSessions.TryAcquire(1) {
 			newChannel.Reject(ssh.ResourceShortage, "too many concurrent sessions")
-			sshdHitMaxSessions.Inc()
+			sshdHitMaxSessions.WithLabelValues(l.name).Inc()
 			continue
 		}
 		ch, requests, err := newChannel.Accept()
 		if err != nil {
-			log.Infof("Could not accept channel: %v", err)
+			logger.WithError(err).Info("Could not accept channel")
 			concurrentSessions.Release(1)
 			continue
 		}
 
-		go handleSession(ctx, concurrentSessions, ch, requests, conn, nconn, cfg)
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+
+			handleSession(ctx, l, concurrentSessions, active, ch, requests, conn, nconn, cfg)
+		}()
 	}
 }
 
-func handleSession(ctx context.Context, concurrentSessions *semaphore.Weighted, ch ssh.Channel, requests <-chan *ssh.Request, conn *ssh.ServerConn, nconn net.Conn, cfg *config.Config) {
+func handleSession(ctx context.Context, l *listener, concurrentSessions *semaphore.Weighted, active *activeSessions, ch ssh.Channel, requests <-chan *ssh.Request, conn *ssh.ServerConn, nconn net.Conn, cfg *config.Config) {
 	defer concurrentSessions.Release(1)
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Each session gets its own correlation ID, the one of the connection is
+	// kept in the logs to relate them.
+	connectionCorrelationID := correlation.ExtractFromContext(ctx)
+	ctx, span := startSpan(ctx, "sshd.session")
+	defer span.Finish()
+
+	stats := newSessionStats(l.name)
+	defer func() {
+		span.SetTag("command", stats.commandType)
+		stats.finish(log.Fields{
+			"listener":                  l.name,
+			"correlation_id":            correlation.ExtractFromContext(ctx),
+			"connection_correlation_id": connectionCorrelationID,
+			"gl_key_id":                 conn.Permissions.Extensions["key-id"],
+			"username":                  conn.Permissions.Extensions["username"],
+			"remote_ip":                 ipFromAddr(nconn.RemoteAddr()),
+		})
+	}()
+
+	session := &sessionChannel{Channel: ch, stats: stats}
+	active.add(session)
+	defer active.remove(session)
+	exit := session.exit
+
+	timer := newIdleTimer()
+	go timer.watch(ctx, cfg.Server.IdleTimeout(), func() {
+		log.WithFields(log.Fields{"listener": l.name, "remote_ip": ipFromAddr(nconn.RemoteAddr())}).Info("Closing session: idle timeout exceeded")
+		sshdDisconnects.WithLabelValues(l.name, disconnectReasonIdleTimeout).Inc()
+		cancel()
+		session.terminate(sessionOutcomeIdleTimeout)
+	})
+
 	rw := &readwriter.ReadWriter{
-		Out:    ch,
-		In:     ch,
-		ErrOut: ch.Stderr(),
+		Out:    stats.writer(timer.writer(ch)),
+		In:     stats.reader(timer.reader(ch)),
+		ErrOut: stats.writer(timer.writer(ch.Stderr())),
 	}
 	var gitProtocolVersion string
+	var envVariables map[string]string
+	newArgs := func(execCmd string) *commandargs.Shell {
+		return &commandargs.Shell{
+			GitlabKeyId:    conn.Permissions.Extensions["key-id"],
+			GitlabUsername: conn.Permissions.Extensions["username"],
+			SSHUser:        conn.User(),
+			SSHUserAccess:  conn.Permissions.Extensions["ssh-user-access"],
+			Env: sshenv.Env{
+				IsSSHConnection:    true,
+				OriginalCommand:    execCmd,
+				GitProtocolVersion: gitProtocolVersion,
+				RemoteAddr:         ipFromAddr(nconn.RemoteAddr()),
+				Variables:          envVariables,
+			},
+		}
+	}
+
+	// The size of the pty requested by the client, and the terminal of the
+	// interactive shell once it's started.
+	var pty *windowChangeRequest
+	var terminal *term.Terminal
+	var shellDone chan struct{}
 
 	for req := range requests {
+		timer.touch()
+
 		var execCmd string
 		switch req.Type {
 		case "env":
@@ -210,15 +669,44 @@ func handleSession(ctx context.Context, concurrentSessions *semaphore.Weighted,
 				ch.Close()
 				return
 			}
-			var accepted bool
-			if envRequest.Name == sshenv.GitProtocolEnv {
+			accepted := true
+			switch {
+			case envRequest.Name == sshenv.GitProtocolEnv:
 				gitProtocolVersion = envRequest.Value
-				accepted = true
+			case isValidEnvName(envRequest.Name) && cfg.Server.AcceptsEnv(envRequest.Name):
+				if envVariables == nil {
+					envVariables = make(map[string]string)
+				}
+				envVariables[envRequest.Name] = envRequest.Value
+			default:
+				accepted = false
 			}
 			if req.WantReply {
 				req.Reply(accepted, []byte{})
 			}
 
+		case "pty-req":
+			// A pty is only useful for the interactive shell
+			var ptyRequest ptyRequest
+			accepted := cfg.Server.InteractiveShell && shellDone == nil && ssh.Unmarshal(req.Payload, &ptyRequest) == nil
+			if accepted {
+				pty = &windowChangeRequest{Columns: ptyRequest.Columns, Rows: ptyRequest.Rows}
+			}
+			if req.WantReply {
+				req.Reply(accepted, []byte{})
+			}
+
+		case "window-change":
+			var windowChange windowChangeRequest
+			if pty == nil || ssh.Unmarshal(req.Payload, &windowChange) != nil {
+				break
+			}
+			if terminal != nil {
+				terminal.SetSize(int(windowChange.Columns), int(windowChange.Rows))
+			} else {
+				*pty = windowChange
+			}
+
 		case "exec":
 			var execRequest execRequest
 			if err := ssh.Unmarshal(req.Payload, &execRequest); err != nil {
@@ -228,37 +716,75 @@ func handleSession(ctx context.Context, concurrentSessions *semaphore.Weighted,
 			execCmd = execRequest.Command
 			fallthrough
 		case "shell":
+			// The menu of the interactive shell only has commands the
+			// deploy_keys users can't run
+			if req.Type == "shell" && cfg.Server.InteractiveShell && conn.Permissions.Extensions["ssh-user-access"] != config.SSHUserAccessDeployKeys {
+				if shellDone != nil {
+					if req.WantReply {
+						req.Reply(false, []byte{})
+					}
+					break
+				}
+				if req.WantReply {
+					req.Reply(true, []byte{})
+				}
+
+				// The shell runs in the background so that window changes
+				// are still handled.
+				var shell *interactiveShell
+				shell, terminal = newInteractiveShell(cfg, rw, pty, newArgs)
+				stats.commandType = sessionCommandShell
+				shellDone = make(chan struct{})
+				go func() {
+					defer close(shellDone)
+
+					shell.run(ctx)
+					exit(0)
+				}()
+				break
+			}
+
 			if req.WantReply {
 				req.Reply(true, []byte{})
 			}
-			args := &commandargs.Shell{
-				GitlabKeyId: conn.Permissions.Extensions["key-id"],
-				Env: sshenv.Env{
-					IsSSHConnection:    true,
-					OriginalCommand:    execCmd,
-					GitProtocolVersion: gitProtocolVersion,
-					RemoteAddr:         nconn.RemoteAddr().(*net.TCPAddr).String(),
-				},
-			}
+			args := newArgs(execCmd)
 
 			if err := args.ParseCommand(execCmd); err != nil {
+				stats.failed(err)
 				fmt.Fprintf(ch.Stderr(), "Failed to parse command: %v\n", err.Error())
-				exitSession(ch, 128)
+				exit(128)
+				return
+			}
+
+			if err := checkSSHUserAccess(args); err != nil {
+				stats.commandType = string(args.CommandType)
+				stats.failed(err)
+				fmt.Fprintf(ch.Stderr(), "remote: ERROR: %v\n", err.Error())
+				exit(1)
 				return
 			}
 
 			cmd := command.BuildShellCommand(args, cfg, rw)
 			if cmd == nil {
 				fmt.Fprintf(ch.Stderr(), "Unknown command: %v\n", args.CommandType)
-				exitSession(ch, 128)
+				exit(128)
 				return
 			}
+			stats.commandType = string(args.CommandType)
+
 			if err := cmd.Execute(ctx); err != nil {
+				var exitErr *handler.ExitError
+				if errors.As(err, &exitErr) {
+					exit(uint32(exitErr.Code))
+					return
+				}
+
+				stats.failed(err)
 				fmt.Fprintf(ch.Stderr(), "remote: ERROR: %v\n", err.Error())
-				exitSession(ch, 1)
+				exit(1)
 				return
 			}
-			exitSession(ch, 0)
+			exit(0)
 			return
 		default:
 			if req.WantReply {
@@ -266,4 +792,8 @@ func handleSession(ctx context.Context, concurrentSessions *semaphore.Weighted,
 			}
 		}
 	}
+
+	if shellDone != nil {
+		<-shellDone
+	}
 }
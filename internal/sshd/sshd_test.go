@@ -0,0 +1,711 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mikesmitty/edkey"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+func TestShutdown(t *testing.T) {
+	s := setupServer(t)
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	require.NoError(t, s.Shutdown())
+
+	_, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientConfig(t, s))
+	require.Error(t, err, "new connections must be refused once shutdown is initiated")
+
+	// The established connection is still usable while the server is draining
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	require.NoError(t, session.Close())
+}
+
+func TestShutdownCancelsActiveConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s, served := startServer(t, ctx)
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	ch, requests, err := client.OpenChannel("session", nil)
+	require.NoError(t, err)
+	defer ch.Close()
+
+	exitSignal := make(chan exitSignalReq, 1)
+	go func() { exitSignal <- waitForExitSignal(t, requests) }()
+
+	require.NoError(t, s.Shutdown())
+
+	select {
+	case <-served:
+		t.Fatal("ListenAndServe returned while a connection was still active")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe didn't return after the context was canceled")
+	}
+
+	require.Equal(t, exitSignalReq{Signal: exitSignalTerm, Message: "server is shutting down"}, <-exitSignal)
+}
+
+func TestShutdownWithoutConnections(t *testing.T) {
+	s, served := startServer(t, context.Background())
+
+	require.NoError(t, s.Shutdown())
+
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe didn't return after shutdown")
+	}
+}
+
+func TestShutdownBeforeListen(t *testing.T) {
+	s := NewServer(buildConfig(t))
+
+	require.NoError(t, s.Shutdown())
+	require.EqualError(t, s.ListenAndServe(context.Background()), "server is shutting down")
+}
+
+func TestProxyProtocol(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		policy         string
+		allowed        []string
+		header         string
+		expectedIP     string
+		expectedFailed bool
+	}{
+		{
+			desc:       "a PROXY v1 header is used",
+			header:     "PROXY TCP4 192.168.1.1 10.0.0.1 1234 22\r\n",
+			expectedIP: "192.168.1.1",
+		},
+		{
+			desc:       "a connection without a header uses the peer address",
+			expectedIP: "127.0.0.1",
+		},
+		{
+			desc:           "a connection without a header is rejected when required",
+			policy:         "require",
+			expectedFailed: true,
+		},
+		{
+			desc:       "a PROXY header is ignored when configured",
+			policy:     "ignore",
+			header:     "PROXY TCP4 192.168.1.1 10.0.0.1 1234 22\r\n",
+			expectedIP: "127.0.0.1",
+		},
+		{
+			desc:           "a PROXY header is rejected when configured",
+			policy:         "reject",
+			header:         "PROXY TCP4 192.168.1.1 10.0.0.1 1234 22\r\n",
+			expectedFailed: true,
+		},
+		{
+			desc:       "a PROXY header from an allowed source is used",
+			allowed:    []string{"127.0.0.0/8"},
+			header:     "PROXY TCP6 2001:db8::1 2001:db8::2 1234 22\r\n",
+			expectedIP: "2001:db8::1",
+		},
+		{
+			desc:           "a PROXY header from an untrusted source is rejected",
+			allowed:        []string{"192.168.0.0/16"},
+			header:         "PROXY TCP4 192.168.1.1 10.0.0.1 1234 22\r\n",
+			expectedFailed: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var checkIP string
+			cfg := buildConfig(t, testserver.TestRequestHandler{
+				Path: "/api/v4/internal/allowed",
+				Handler: func(w http.ResponseWriter, r *http.Request) {
+					var request map[string]interface{}
+					json.NewDecoder(r.Body).Decode(&request)
+					checkIP, _ = request["check_ip"].(string)
+
+					w.WriteHeader(http.StatusForbidden)
+					json.NewEncoder(w).Encode(map[string]interface{}{"status": false, "message": "denied"})
+				},
+			})
+			cfg.Server.ProxyProtocol = true
+			cfg.Server.ProxyPolicy = tc.policy
+			cfg.Server.ProxyAllowed = tc.allowed
+
+			s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+			conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			if tc.header != "" {
+				_, err := conn.Write([]byte(tc.header))
+				require.NoError(t, err)
+			}
+
+			sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", clientConfig(t, s))
+			if tc.expectedFailed {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			client := ssh.NewClient(sshConn, chans, reqs)
+			defer client.Close()
+
+			session, err := client.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+
+			require.Error(t, session.Run("git-receive-pack group/project.git"))
+			require.Equal(t, tc.expectedIP, checkIP)
+		})
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.Listeners = []config.ListenerConfig{
+		{Name: "tcp", Listen: "127.0.0.1:0"},
+		{
+			Name:                   "sidecar",
+			Network:                "unix",
+			Listen:                 filepath.Join(tempDir(t), "sshd.sock"),
+			ConnectionLimitsConfig: config.ConnectionLimitsConfig{MaxConnections: 1},
+		},
+	}
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+	require.Len(t, s.listeners, 2)
+
+	authenticated := sshdAuthentications.WithLabelValues("sidecar", authResultSuccess, authReasonPublicKey)
+	authenticatedBefore := testutil.ToFloat64(authenticated)
+
+	tcpClient, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientConfig(t, s))
+	require.NoError(t, err)
+	defer tcpClient.Close()
+
+	unixClient, err := ssh.Dial("unix", s.listeners[1].Addr().String(), clientConfig(t, s))
+	require.NoError(t, err)
+	defer unixClient.Close()
+
+	// The metrics are labeled with the listener of the connection
+	require.Equal(t, authenticatedBefore+1, testutil.ToFloat64(authenticated))
+
+	// The limits only apply to the connections of their own listener
+	limited := sshdHitConnectionLimits.WithLabelValues("sidecar", limitReasonMaxConnections)
+	limitedBefore := testutil.ToFloat64(limited)
+
+	_, err = ssh.Dial("unix", s.listeners[1].Addr().String(), clientConfig(t, s))
+	require.Error(t, err)
+	require.Equal(t, limitedBefore+1, testutil.ToFloat64(limited))
+
+	client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientConfig(t, s))
+	require.NoError(t, err)
+	client.Close()
+
+	require.Equal(t, float64(1), testutil.ToFloat64(sshdInFlightConnections.WithLabelValues("sidecar")))
+}
+
+func TestProxyProtocolOnUnixSocket(t *testing.T) {
+	var checkIP string
+	cfg := buildConfig(t, testserver.TestRequestHandler{
+		Path: "/api/v4/internal/allowed",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			var request map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&request)
+			checkIP, _ = request["check_ip"].(string)
+
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": false, "message": "denied"})
+		},
+	})
+	cfg.Server.Listeners = []config.ListenerConfig{
+		{Name: "sidecar", Network: "unix", Listen: filepath.Join(tempDir(t), "sshd.sock"), ProxyProtocol: true, ProxyPolicy: "require"},
+		// Rejected by IsSane, the peers of a Unix socket can't be allowed
+		{Name: "allowlist", Network: "unix", Listen: filepath.Join(tempDir(t), "allowlist.sock"), ProxyProtocol: true, ProxyAllowed: []string{"127.0.0.1"}},
+	}
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+	require.Len(t, s.listeners, 2)
+
+	dial := func(addr, header string) (*ssh.Client, error) {
+		conn, err := net.Dial("unix", addr)
+		require.NoError(t, err)
+
+		if header != "" {
+			_, err := conn.Write([]byte(header))
+			require.NoError(t, err)
+		}
+
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", clientConfig(t, s))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return ssh.NewClient(sshConn, chans, reqs), nil
+	}
+
+	t.Run("the PROXY header is used", func(t *testing.T) {
+		client, err := dial(s.listeners[0].Addr().String(), "PROXY TCP4 192.168.1.1 10.0.0.1 1234 22\r\n")
+		require.NoError(t, err)
+		defer client.Close()
+
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+
+		require.Error(t, session.Run("git-receive-pack group/project.git"))
+		require.Equal(t, "192.168.1.1", checkIP)
+	})
+
+	t.Run("a connection without a header is rejected when required", func(t *testing.T) {
+		_, err := dial(s.listeners[0].Addr().String(), "")
+		require.Error(t, err)
+	})
+
+	t.Run("an allowlist rejects the headers of the peers", func(t *testing.T) {
+		_, err := dial(s.listeners[1].Addr().String(), "PROXY TCP4 192.168.1.1 10.0.0.1 1234 22\r\n")
+		require.Error(t, err)
+
+		client, err := dial(s.listeners[1].Addr().String(), "")
+		require.NoError(t, err)
+		require.NoError(t, client.Close())
+	})
+}
+
+func TestCorrelationID(t *testing.T) {
+	correlationIDs := make(chan string, 2)
+	recordCorrelationID := func(r *http.Request) {
+		correlationIDs <- r.Header.Get("X-Request-Id")
+	}
+
+	cfg := buildConfig(t)
+	cfg.GitlabUrl = testserver.StartHttpServer(t, []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				recordCorrelationID(r)
+				json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "key": r.FormValue("key")})
+			},
+		},
+		{
+			Path: "/api/v4/internal/discover",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				recordCorrelationID(r)
+				json.NewEncoder(w).Encode(map[string]interface{}{"id": 2, "username": "alex-doe", "name": "Alex Doe"})
+			},
+		},
+	})
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	_, err = session.Output("")
+	require.NoError(t, err)
+
+	connectionID := <-correlationIDs
+	sessionID := <-correlationIDs
+	require.NotEmpty(t, connectionID)
+	require.NotEmpty(t, sessionID)
+	require.NotEqual(t, connectionID, sessionID, "each session must get its own correlation ID")
+}
+
+func TestEnvRequests(t *testing.T) {
+	var sshEnv interface{}
+	cfg := buildConfig(t, testserver.TestRequestHandler{
+		Path: "/api/v4/internal/allowed",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			var request map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&request)
+			sshEnv = request["ssh_env"]
+
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": false, "message": "denied"})
+		},
+	})
+	cfg.Server.AcceptEnv = []string{"GIT_TRACE_PACKET", "GL_*"}
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	require.NoError(t, session.Setenv("GIT_PROTOCOL", "version=2"))
+	require.NoError(t, session.Setenv("GIT_TRACE_PACKET", "1"))
+	require.NoError(t, session.Setenv("GL_OPTION", "value"))
+	require.Error(t, session.Setenv("LD_PRELOAD", "/tmp/evil.so"))
+
+	require.Error(t, session.Run("git-receive-pack group/project.git"))
+	require.Equal(t, map[string]interface{}{"GIT_TRACE_PACKET": "1", "GL_OPTION": "value"}, sshEnv)
+}
+
+func TestSSHUsers(t *testing.T) {
+	var sshUser, sshUserAccess interface{}
+	cfg := buildConfig(t, testserver.TestRequestHandler{
+		Path: "/api/v4/internal/allowed",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			var request map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&request)
+			sshUser = request["ssh_user"]
+			sshUserAccess = request["ssh_user_access"]
+
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": false, "message": "denied"})
+		},
+	})
+	cfg.Server.Users = []config.SSHUserConfig{
+		{Name: "git"},
+		{Name: "deploy", Access: config.SSHUserAccessDeployKeys},
+		{Name: "mirror"},
+	}
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	testCases := []struct {
+		user   string
+		access string
+	}{
+		{user: "git", access: config.SSHUserAccessAll},
+		{user: "deploy", access: config.SSHUserAccessDeployKeys},
+		{user: "mirror", access: config.SSHUserAccessAll},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.user, func(t *testing.T) {
+			clientCfg := clientConfig(t, s)
+			clientCfg.User = tc.user
+			client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+			require.NoError(t, err)
+			defer client.Close()
+
+			session, err := client.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+
+			require.Error(t, session.Run("git-upload-pack group/project.git"))
+			require.Equal(t, tc.user, sshUser)
+			require.Equal(t, tc.access, sshUserAccess)
+		})
+	}
+
+	clientCfg := clientConfig(t, s)
+	clientCfg.User = "root"
+	_, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+	require.Error(t, err, "unknown users must be rejected")
+}
+
+func TestSSHUserDeployKeysOnly(t *testing.T) {
+	var requested int32
+	recordRequest := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requested, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	}
+	cfg := buildConfig(t,
+		testserver.TestRequestHandler{Path: "/api/v4/internal/personal_access_token", Handler: recordRequest},
+		testserver.TestRequestHandler{Path: "/api/v4/internal/two_factor_recovery_codes", Handler: recordRequest},
+		testserver.TestRequestHandler{Path: "/api/v4/internal/discover", Handler: recordRequest},
+	)
+	cfg.Server.Users = []config.SSHUserConfig{
+		{Name: "git"},
+		{Name: "deploy", Access: config.SSHUserAccessDeployKeys},
+	}
+	cfg.Server.InteractiveShell = true
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	// The key isn't a deploy key, and these commands don't check it with
+	// the /allowed API call
+	clientCfg := clientConfig(t, s)
+	clientCfg.User = "deploy"
+	client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	for desc, cmd := range map[string]string{
+		"personal access token": "personal_access_token token api",
+		"2FA recovery codes":    "2fa_recovery_codes",
+		"discover":              "discover",
+		"interactive shell":     "",
+	} {
+		t.Run(desc, func(t *testing.T) {
+			session, err := client.NewSession()
+			require.NoError(t, err)
+			defer session.Close()
+
+			var stderr bytes.Buffer
+			session.Stderr = &stderr
+			if cmd == "" {
+				require.NoError(t, session.Shell())
+				err = session.Wait()
+			} else {
+				err = session.Run(cmd)
+			}
+
+			var exitErr *ssh.ExitError
+			require.True(t, errors.As(err, &exitErr), "unexpected error %v", err)
+			require.Equal(t, 1, exitErr.ExitStatus())
+			require.Equal(t, "remote: ERROR: Only git commands are accepted for this SSH user\n", stderr.String())
+		})
+	}
+
+	require.Equal(t, int32(0), atomic.LoadInt32(&requested))
+}
+
+func TestInvalidProxyConfig(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		policy        string
+		allowed       []string
+		expectedError string
+	}{
+		{
+			desc:          "an unknown policy",
+			policy:        "trust-everyone",
+			expectedError: `invalid PROXY protocol configuration of listener "default": unknown proxy_policy "trust-everyone"`,
+		},
+		{
+			desc:          "an invalid allowed source",
+			allowed:       []string{"not-an-ip"},
+			expectedError: `invalid PROXY protocol configuration of listener "default": proxyproto: given string "not-an-ip" is not a valid IP address`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := buildConfig(t)
+			cfg.Server.ProxyProtocol = true
+			cfg.Server.ProxyPolicy = tc.policy
+			cfg.Server.ProxyAllowed = tc.allowed
+
+			s := NewServer(cfg)
+			require.EqualError(t, s.ListenAndServe(context.Background()), tc.expectedError)
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	cfg := buildConfig(t)
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	oldKey := hostKey(t, s)
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	newKey := writeHostKey(t, cfg.Server.HostKeyFiles[0])
+	require.NoError(t, s.Reload())
+	require.Equal(t, newKey, hostKey(t, s))
+	require.NotEqual(t, oldKey, newKey)
+
+	// Established connections are not affected by the reload
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	require.NoError(t, session.Close())
+
+	// A failed reload keeps the current keys
+	require.NoError(t, ioutil.WriteFile(cfg.Server.HostKeyFiles[0], []byte("invalid"), 0600))
+	require.EqualError(t, s.Reload(), "No host keys could be loaded, aborting")
+	require.Equal(t, newKey, hostKey(t, s))
+}
+
+func TestReloadConfig(t *testing.T) {
+	cfg := buildConfig(t)
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+	oldKeyFiles := cfg.Server.HostKeyFiles
+
+	// The key files are replaced by the configuration read again
+	newKeyFile := filepath.Join(tempDir(t), "new_hostkey")
+	newKey := writeHostKey(t, newKeyFile)
+
+	newCfg := buildConfig(t)
+	newCfg.Server.HostKeyFiles = []string{newKeyFile}
+	newCfg.Server.ClientAliveCountMax = 42
+	require.NoError(t, s.ReloadConfig(newCfg))
+	require.Equal(t, newKey, hostKey(t, s))
+	require.Equal(t, []string{newKeyFile}, s.Config.Server.HostKeyFiles)
+	require.Equal(t, config.DefaultServerConfig.ClientAliveCountMax, s.Config.Server.ClientAliveCountMax, "only the key settings are reloaded")
+
+	// Invalid settings are not applied
+	newCfg.Server.HostKeyFiles = oldKeyFiles
+	newCfg.Server.TrustedUserCAKeys = filepath.Join(tempDir(t), "missing")
+	newCfg.Server.AuthorizedPrincipals = []string{"gitlab"}
+	require.Error(t, s.ReloadConfig(newCfg))
+	require.Equal(t, newKey, hostKey(t, s))
+	require.Equal(t, []string{newKeyFile}, s.Config.Server.HostKeyFiles)
+	require.Empty(t, s.Config.Server.TrustedUserCAKeys)
+	require.Empty(t, s.Config.Server.AuthorizedPrincipals)
+}
+
+// waitForExitSignal returns the exit signal sent on a session channel, or an
+// empty one if the channel is closed without it.
+func waitForExitSignal(t *testing.T, requests <-chan *ssh.Request) exitSignalReq {
+	var exitSignal exitSignalReq
+	for req := range requests {
+		if req.Type == "exit-signal" {
+			require.NoError(t, ssh.Unmarshal(req.Payload, &exitSignal))
+		}
+	}
+
+	return exitSignal
+}
+
+func hostKey(t *testing.T, s *Server) ssh.PublicKey {
+	t.Helper()
+
+	var key ssh.PublicKey
+	cfg := clientConfig(t, s)
+	cfg.HostKeyCallback = func(_ string, _ net.Addr, k ssh.PublicKey) error {
+		key = k
+		return nil
+	}
+
+	client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), cfg)
+	require.NoError(t, err)
+	client.Close()
+
+	return key
+}
+
+func setupServer(t *testing.T) *Server {
+	t.Helper()
+
+	s, _ := startServer(t, context.Background())
+
+	return s
+}
+
+func startServer(t *testing.T, ctx context.Context) (*Server, chan error) {
+	t.Helper()
+
+	return startServerWithConfig(t, ctx, buildConfig(t))
+}
+
+func startServerWithConfig(t *testing.T, ctx context.Context, cfg *config.Config) (*Server, chan error) {
+	t.Helper()
+
+	s := NewServer(cfg)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ListenAndServe(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		return len(s.listeners) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.Cleanup(func() { s.Shutdown() })
+
+	return s, served
+}
+
+func buildConfig(t *testing.T, handlers ...testserver.TestRequestHandler) *config.Config {
+	t.Helper()
+
+	requests := append([]testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]interface{}{"id": 1, "key": r.FormValue("key")})
+			},
+		},
+	}, handlers...)
+
+	url := testserver.StartHttpServer(t, requests)
+
+	hostKeyFile := filepath.Join(tempDir(t), "hostkey")
+	writeHostKey(t, hostKeyFile)
+
+	cfg := &config.Config{}
+	*cfg = config.DefaultConfig
+	cfg.GitlabUrl = url
+	cfg.Server.Listen = "127.0.0.1:0"
+	cfg.Server.HostKeyFiles = []string{hostKeyFile}
+
+	return cfg
+}
+
+func writeHostKey(t *testing.T, filename string) ssh.PublicKey {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	block := &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: edkey.MarshalED25519PrivateKey(priv)}
+	require.NoError(t, ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600))
+
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+
+	return key
+}
+
+func clientConfig(t *testing.T, s *Server) *ssh.ClientConfig {
+	t.Helper()
+
+	_, clientPrivKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	clientSigner, err := ssh.NewSignerFromKey(clientPrivKey)
+	require.NoError(t, err)
+
+	return &ssh.ClientConfig{
+		User:            s.Config.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+}
+
+func buildClient(t *testing.T, s *Server) *ssh.Client {
+	t.Helper()
+
+	client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientConfig(t, s))
+	require.NoError(t, err)
+
+	return client
+}
@@ -0,0 +1,190 @@
+package sshd
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	authResultSuccess = "success"
+	authResultFailure = "failure"
+
+	authReasonPublicKey          = "public_key"
+	authReasonCertificate        = "certificate"
+	authReasonUnknownUser        = "unknown_user"
+	authReasonDSA                = "dsa"
+	authReasonProhibitedKey      = "prohibited_key"
+	authReasonInvalidCertificate = "invalid_certificate"
+	authReasonKeyNotFound        = "key_not_found"
+	authReasonAPIError           = "api_error"
+	authReasonBanned             = "banned"
+	authReasonOTP                = "otp"
+	authReasonInvalidOTP         = "invalid_otp"
+
+	// Used as the command type until a known command is run, so that the
+	// arbitrary commands sent by clients don't end up as label values.
+	sessionCommandUnknown = "unknown"
+	sessionCommandShell   = "interactive_shell"
+	// Used as the exit status of sessions closed without running a command.
+	sessionExitStatusNone = "none"
+
+	sessionOutcomeSuccess     = "success"
+	sessionOutcomeFailure     = "failure"
+	sessionOutcomeError       = "error"
+	sessionOutcomeClosed      = "closed"
+	sessionOutcomeIdleTimeout = "idle_timeout"
+	sessionOutcomeShutdown    = "shutdown"
+)
+
+// sessionStats collects the metrics of a single session, which are only
+// reported and logged once it's finished.
+type sessionStats struct {
+	listener    string
+	begin       time.Time
+	commandType string
+
+	// The session can be ended by other goroutines, so the way it ended is
+	// protected by mu.
+	mu           sync.Mutex
+	exitStatus   string
+	terminatedBy string
+	err          error
+
+	// The byte counters are only accessed atomically.
+	bytesIn  int64
+	bytesOut int64
+}
+
+func newSessionStats(listener string) *sessionStats {
+	sshdInFlightSessions.WithLabelValues(listener).Inc()
+
+	return &sessionStats{
+		listener:    listener,
+		begin:       time.Now(),
+		commandType: sessionCommandUnknown,
+		exitStatus:  sessionExitStatusNone,
+	}
+}
+
+func (s *sessionStats) exited(exitStatus uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.exitStatus = strconv.FormatUint(uint64(exitStatus), 10)
+}
+
+// terminated records that the server ended the session before its command
+// exited.
+func (s *sessionStats) terminated(outcome string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.terminatedBy = outcome
+}
+
+// failed records the error of the command run by the session.
+func (s *sessionStats) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+func (s *sessionStats) outcome() string {
+	switch {
+	case s.terminatedBy != "":
+		return s.terminatedBy
+	case s.exitStatus == sessionExitStatusNone:
+		return sessionOutcomeClosed
+	case s.err != nil:
+		return sessionOutcomeError
+	case s.exitStatus == "0":
+		return sessionOutcomeSuccess
+	default:
+		return sessionOutcomeFailure
+	}
+}
+
+// finish reports the metrics of the session and logs it with the given fields.
+func (s *sessionStats) finish(fields log.Fields) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	duration := time.Since(s.begin)
+	bytesIn := atomic.LoadInt64(&s.bytesIn)
+	bytesOut := atomic.LoadInt64(&s.bytesOut)
+
+	sshdInFlightSessions.WithLabelValues(s.listener).Dec()
+	sshdTransferredBytes.WithLabelValues(s.listener, s.commandType, "in").Add(float64(bytesIn))
+	sshdTransferredBytes.WithLabelValues(s.listener, s.commandType, "out").Add(float64(bytesOut))
+	sshdSessionDuration.WithLabelValues(s.listener, s.commandType, s.exitStatus).Observe(duration.Seconds())
+
+	logger := log.WithFields(fields).WithFields(log.Fields{
+		"command":     s.commandType,
+		"duration_s":  duration.Seconds(),
+		"bytes_in":    bytesIn,
+		"bytes_out":   bytesOut,
+		"exit_status": s.exitStatus,
+		"outcome":     s.outcome(),
+	})
+	if s.err != nil {
+		logger = logger.WithError(s.err)
+	}
+	logger.Info("Session finished")
+}
+
+func (s *sessionStats) reader(r io.Reader) io.Reader {
+	return &countingReader{Reader: r, count: &s.bytesIn}
+}
+
+func (s *sessionStats) writer(w io.Writer) io.Writer {
+	return &countingWriter{Writer: w, count: &s.bytesOut}
+}
+
+type countingReader struct {
+	io.Reader
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+
+	return n, err
+}
+
+type countingWriter struct {
+	io.Writer
+	count *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(w.count, int64(n))
+
+	return n, err
+}
+
+func observeAuthentication(l *listener, reason string, err error) {
+	result := authResultSuccess
+	if err != nil {
+		result = authResultFailure
+	}
+
+	sshdAuthentications.WithLabelValues(l.name, result, reason).Inc()
+}
+
+// rejectedKeyReason returns the reason reported when checkPublicKey rejects a key.
+func rejectedKeyReason(key ssh.PublicKey) string {
+	if key.Type() == ssh.KeyAlgoDSA {
+		return authReasonDSA
+	}
+
+	return authReasonProhibitedKey
+}
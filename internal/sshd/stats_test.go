@@ -0,0 +1,165 @@
+package sshd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/client/testserver"
+)
+
+func TestAuthenticationMetrics(t *testing.T) {
+	cfg := buildConfig(t)
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	testCases := []struct {
+		desc   string
+		user   string
+		result string
+		reason string
+	}{
+		{desc: "success", user: cfg.User, result: authResultSuccess, reason: authReasonPublicKey},
+		{desc: "unknown user", user: "unknown", result: authResultFailure, reason: authReasonUnknownUser},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			counter := sshdAuthentications.WithLabelValues(s.listeners[0].name, tc.result, tc.reason)
+			before := testutil.ToFloat64(counter)
+
+			clientCfg := clientConfig(t, s)
+			clientCfg.User = tc.user
+			client, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientCfg)
+			if err == nil {
+				client.Close()
+			}
+
+			require.Equal(t, before+1, testutil.ToFloat64(counter))
+		})
+	}
+}
+
+func TestAuthenticationMetricsKeyNotFound(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.GitlabUrl = testserver.StartHttpServer(t, []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			},
+		},
+	})
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	counter := sshdAuthentications.WithLabelValues(s.listeners[0].name, authResultFailure, authReasonKeyNotFound)
+	before := testutil.ToFloat64(counter)
+
+	_, err := ssh.Dial("tcp", s.listeners[0].Addr().String(), clientConfig(t, s))
+	require.Error(t, err)
+
+	require.Equal(t, before+1, testutil.ToFloat64(counter))
+}
+
+func TestSessionMetrics(t *testing.T) {
+	cfg := buildConfig(t, testserver.TestRequestHandler{
+		Path: "/api/v4/internal/discover",
+		Handler: func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": 2, "username": "alex-doe", "name": "Alex Doe"})
+		},
+	})
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	t.Run("known command", func(t *testing.T) {
+		bytesOut := sshdTransferredBytes.WithLabelValues(s.listeners[0].name, "discover", "out")
+		bytesBefore := testutil.ToFloat64(bytesOut)
+		sessionsBefore := sessionCount(t, s.listeners[0].name, "discover", "0")
+
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+
+		output, err := session.Output("")
+		require.NoError(t, err)
+		require.Equal(t, "Welcome to GitLab, @alex-doe!\n", string(output))
+
+		require.Eventually(t, func() bool {
+			return sessionCount(t, s.listeners[0].name, "discover", "0") == sessionsBefore+1
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, bytesBefore+float64(len(output)), testutil.ToFloat64(bytesOut))
+	})
+
+	t.Run("unknown command", func(t *testing.T) {
+		sessionsBefore := sessionCount(t, s.listeners[0].name, sessionCommandUnknown, "128")
+
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		defer session.Close()
+
+		require.Error(t, session.Run("rm -rf /"))
+
+		// Arbitrary commands aren't used as label values
+		require.Eventually(t, func() bool {
+			return sessionCount(t, s.listeners[0].name, sessionCommandUnknown, "128") == sessionsBefore+1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func sessionCount(t *testing.T, listener, commandType, exitStatus string) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+	histogram := sshdSessionDuration.WithLabelValues(listener, commandType, exitStatus).(prometheus.Histogram)
+	require.NoError(t, histogram.Write(&metric))
+
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestSessionOutcome(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		end      func(s *sessionStats)
+		expected string
+	}{
+		{desc: "success", end: func(s *sessionStats) { s.exited(0) }, expected: sessionOutcomeSuccess},
+		{desc: "failure", end: func(s *sessionStats) { s.exited(128) }, expected: sessionOutcomeFailure},
+		{
+			desc: "error",
+			end: func(s *sessionStats) {
+				s.failed(errors.New("error"))
+				s.exited(1)
+			},
+			expected: sessionOutcomeError,
+		},
+		{desc: "closed", end: func(s *sessionStats) {}, expected: sessionOutcomeClosed},
+		{
+			desc: "terminated",
+			end: func(s *sessionStats) {
+				s.terminated(sessionOutcomeShutdown)
+				s.failed(errors.New("context canceled"))
+			},
+			expected: sessionOutcomeShutdown,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := newSessionStats("default")
+			defer s.finish(nil)
+
+			tc.end(s)
+			require.Equal(t, tc.expected, s.outcome())
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	disconnectReasonLoginGraceTime = "login_grace_time"
+	disconnectReasonClientAlive    = "client_alive"
+	disconnectReasonIdleTimeout    = "idle_timeout"
+
+	keepAliveRequest = "keepalive@openssh.com"
+)
+
+// keepAlive sends a keepalive request to the client every interval, like the
+// ClientAliveInterval option of OpenSSH. A request counts as missed from the
+// tick it's sent on until it's answered, so the connection is closed maxMissed
+// intervals after the client stopped answering, and never before its request
+// had an interval to be answered. Like with OpenSSH, it's never closed when
+// maxMissed is 0, the requests only keep it active.
+func keepAlive(ctx context.Context, l *listener, conn *ssh.ServerConn, interval time.Duration, maxMissed int) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			missed++
+			if !pending {
+				pending = true
+				go func() {
+					// Any reply, even a failure, means the client is alive
+					_, _, err := conn.SendRequest(keepAliveRequest, true, nil)
+					replies <- err
+				}()
+				continue
+			}
+
+			if maxMissed > 0 && missed >= maxMissed {
+				log.WithFields(log.Fields{"listener": l.name, "remote_ip": ipFromAddr(conn.RemoteAddr())}).Info("Closing connection: client is not responding to keepalive requests")
+				sshdDisconnects.WithLabelValues(l.name, disconnectReasonClientAlive).Inc()
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// idleTimer keeps track of the last time data was transferred on a session.
+type idleTimer struct {
+	// lastActivity is the time of the last activity in Unix nanoseconds. It's
+	// only accessed atomically.
+	lastActivity int64
+}
+
+func newIdleTimer() *idleTimer {
+	t := &idleTimer{}
+	t.touch()
+
+	return t
+}
+
+func (t *idleTimer) touch() {
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+}
+
+func (t *idleTimer) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&t.lastActivity)))
+}
+
+// watch calls onIdle once nothing happened for the given timeout. It returns
+// when ctx is canceled.
+func (t *idleTimer) watch(ctx context.Context, timeout time.Duration, onIdle func()) {
+	if timeout <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			idle := t.idleTime()
+			if idle >= timeout {
+				onIdle()
+				return
+			}
+
+			timer.Reset(timeout - idle)
+		}
+	}
+}
+
+func (t *idleTimer) reader(r io.Reader) io.Reader {
+	return &idleTimerReader{Reader: r, timer: t}
+}
+
+func (t *idleTimer) writer(w io.Writer) io.Writer {
+	return &idleTimerWriter{Writer: w, timer: t}
+}
+
+type idleTimerReader struct {
+	io.Reader
+	timer *idleTimer
+}
+
+func (r *idleTimerReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.timer.touch()
+
+	return n, err
+}
+
+type idleTimerWriter struct {
+	io.Writer
+	timer *idleTimer
+}
+
+func (w *idleTimerWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.timer.touch()
+
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
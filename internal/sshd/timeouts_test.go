@@ -0,0 +1,202 @@
+package sshd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoginGraceTime(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.LoginGraceTimeSeconds = 1
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Never complete the handshake
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.Copy(ioutil.Discard, conn)
+	require.NoError(t, err, "the server should close the connection before the deadline")
+}
+
+func TestLoginGraceTimeWithoutProxyHeader(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.LoginGraceTimeSeconds = 1
+	cfg.Server.ProxyProtocol = true
+	cfg.Server.ConnectionLimitsConfig.MaxConnections = 1
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	timedOut := sshdDisconnects.WithLabelValues(s.listeners[0].name, disconnectReasonLoginGraceTime)
+	timedOutBefore := testutil.ToFloat64(timedOut)
+
+	conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Never send the PROXY header
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.Copy(ioutil.Discard, conn)
+	require.NoError(t, err, "the server should close the connection before the deadline")
+	require.Equal(t, timedOutBefore+1, testutil.ToFloat64(timedOut))
+
+	// The silent connection didn't take the only one allowed
+	client := buildClient(t, s)
+	require.NoError(t, client.Close())
+}
+
+func TestClientAliveInterval(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.ClientAliveIntervalSeconds = 1
+	cfg.Server.ClientAliveCountMax = 1
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	t.Run("a responsive client is kept", func(t *testing.T) {
+		client := buildClient(t, s)
+		defer client.Close()
+
+		time.Sleep(2500 * time.Millisecond)
+
+		session, err := client.NewSession()
+		require.NoError(t, err)
+		require.NoError(t, session.Close())
+	})
+
+	t.Run("an unresponsive client is disconnected", func(t *testing.T) {
+		conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		sshConn, _, _, err := ssh.NewClientConn(conn, "", clientConfig(t, s))
+		require.NoError(t, err)
+		defer sshConn.Close()
+
+		// The global requests are never read, so the keepalive requests
+		// are never answered
+		done := make(chan error, 1)
+		go func() { done <- sshConn.Wait() }()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the connection wasn't closed")
+		}
+	})
+}
+
+func TestClientAliveCountMax(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.ClientAliveIntervalSeconds = 1
+	cfg.Server.ClientAliveCountMax = 3
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sshConn, _, _, err := ssh.NewClientConn(conn, "", clientConfig(t, s))
+	require.NoError(t, err)
+	defer sshConn.Close()
+
+	// The keepalive requests are never answered, so the connection is closed
+	// on the third tick
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- sshConn.Wait() }()
+
+	select {
+	case <-done:
+		elapsed := time.Since(start)
+		require.True(t, elapsed > 2500*time.Millisecond && elapsed < 3500*time.Millisecond, "the connection was closed after %v", elapsed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection wasn't closed")
+	}
+}
+
+func TestClientAliveCountMaxDisabled(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.ClientAliveIntervalSeconds = 1
+	cfg.Server.ClientAliveCountMax = 0
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	conn, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sshConn, _, _, err := ssh.NewClientConn(conn, "", clientConfig(t, s))
+	require.NoError(t, err)
+	defer sshConn.Close()
+
+	// The keepalive requests are never answered
+	done := make(chan error, 1)
+	go func() { done <- sshConn.Wait() }()
+
+	select {
+	case <-done:
+		t.Fatal("the connection was closed")
+	case <-time.After(2500 * time.Millisecond):
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	cfg := buildConfig(t)
+	cfg.Server.IdleTimeoutSeconds = 1
+
+	s, _ := startServerWithConfig(t, context.Background(), cfg)
+
+	client := buildClient(t, s)
+	defer client.Close()
+
+	ch, requests, err := client.OpenChannel("session", nil)
+	require.NoError(t, err)
+	defer ch.Close()
+
+	done := make(chan exitSignalReq, 1)
+	go func() { done <- waitForExitSignal(t, requests) }()
+
+	select {
+	case exitSignal := <-done:
+		require.Equal(t, exitSignalReq{Signal: exitSignalTerm, Message: "idle timeout exceeded"}, exitSignal)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle session wasn't closed")
+	}
+
+	// The connection itself stays open
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	require.NoError(t, session.Close())
+}
+
+func TestIdleTimer(t *testing.T) {
+	timer := newIdleTimer()
+
+	idle := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	go timer.watch(ctx, 200*time.Millisecond, func() { close(idle) })
+
+	// Activity keeps the session alive
+	w := timer.writer(ioutil.Discard)
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("data"))
+	}
+
+	<-idle
+	require.True(t, time.Since(start) >= 700*time.Millisecond)
+}
@@ -0,0 +1,165 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"gitlab.com/gitlab-org/gitlab-shell/internal/config"
+)
+
+// upgradeTimeout is how long the new process has to start accepting
+// connections during an upgrade.
+const upgradeTimeout = time.Minute
+
+// Upgrade starts a new process from the gitlab-sshd binary on disk and passes
+// it the listening sockets, so that no connection is refused while the binary
+// is replaced. It returns once the new process accepts connections; this
+// process then stops serving the monitoring endpoint, and should be shut down,
+// which lets its sessions finish.
+func (s *Server) Upgrade() error {
+	s.mu.Lock()
+	switch {
+	case s.onShutdown:
+		s.mu.Unlock()
+		return errors.New("server is shutting down")
+	case s.upgrading:
+		s.mu.Unlock()
+		return errors.New("an upgrade is already in progress")
+	case len(s.listeners) == 0:
+		s.mu.Unlock()
+		return errors.New("not listening yet")
+	}
+	s.upgrading = true
+	listeners, webListener := s.listeners, s.webListener
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.upgrading = false
+	}()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var names []string
+	addSocket := func(name string, socket net.Listener) error {
+		f, err := socketFile(name, socket)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, f)
+		names = append(names, name)
+
+		return nil
+	}
+
+	for _, l := range listeners {
+		if err := addSocket(l.name, l.socket); err != nil {
+			return err
+		}
+	}
+	if webListener != nil {
+		if err := addSocket(config.MonitoringListenerName, webListener.Listener); err != nil {
+			return err
+		}
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = upgradeEnv(os.Environ(), names, listenFDsStart+len(files))
+
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start the new process: %w", err)
+	}
+
+	log.WithFields(log.Fields{"pid": cmd.Process.Pid, "executable": executable}).Info("Started the new process, waiting for it to be ready")
+
+	if err := waitForReady(ready, upgradeTimeout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		return err
+	}
+
+	// The new process outlives this one
+	go cmd.Wait()
+
+	for _, l := range listeners {
+		l.handOver()
+	}
+	if webListener != nil {
+		webListener.handOver()
+	}
+
+	return nil
+}
+
+// upgradeEnv returns the environment of the new process, with the names of
+// the passed sockets and the file descriptor to write to once it's ready.
+func upgradeEnv(environ []string, names []string, readyFD int) []string {
+	var env []string
+	for _, kv := range environ {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case listenPIDEnv, listenFDsEnv, listenFDNamesEnv, upgradeFDNamesEnv, upgradeReadyFDEnv:
+			continue
+		}
+
+		env = append(env, kv)
+	}
+
+	return append(env,
+		upgradeFDNamesEnv+"="+strings.Join(names, ":"),
+		upgradeReadyFDEnv+"="+strconv.Itoa(readyFD),
+	)
+}
+
+// waitForReady waits for the new process to write to the ready pipe. The pipe
+// is closed without any data if the process exits before.
+func waitForReady(ready *os.File, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		if err == io.EOF {
+			err = errors.New("the new process exited before accepting connections")
+		}
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for the new process to accept connections")
+	}
+}
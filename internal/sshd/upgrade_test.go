@@ -0,0 +1,59 @@
+package sshd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradeEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/usr/bin",
+		"LISTEN_PID=1",
+		"LISTEN_FDS=1",
+		"LISTEN_FDNAMES=ssh",
+		"GITLAB_SSHD_LISTEN_FDNAMES=default",
+		"GITLAB_SSHD_READY_FD=4",
+	}
+
+	require.Equal(t, []string{
+		"PATH=/usr/bin",
+		"GITLAB_SSHD_LISTEN_FDNAMES=public:sidecar:monitoring",
+		"GITLAB_SSHD_READY_FD=6",
+	}, upgradeEnv(environ, []string{"public", "sidecar", "monitoring"}, 6))
+}
+
+func TestWaitForReady(t *testing.T) {
+	t.Run("ready", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		defer r.Close()
+
+		_, err = w.Write([]byte{1})
+		require.NoError(t, err)
+		w.Close()
+
+		require.NoError(t, waitForReady(r, time.Second))
+	})
+
+	t.Run("exited", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		defer r.Close()
+
+		w.Close()
+
+		require.EqualError(t, waitForReady(r, time.Second), "the new process exited before accepting connections")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		defer r.Close()
+		defer w.Close()
+
+		require.EqualError(t, waitForReady(r, 10*time.Millisecond), "timed out waiting for the new process to accept connections")
+	})
+}
@@ -19,6 +19,9 @@ type Env struct {
 	IsSSHConnection    bool
 	OriginalCommand    string
 	RemoteAddr         string
+	// Variables holds the other environment variables sent by the client that
+	// were accepted by the server. They are forwarded to GitLab and Gitaly.
+	Variables map[string]string
 }
 
 func NewFromEnv() Env {